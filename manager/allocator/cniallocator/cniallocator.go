@@ -0,0 +1,608 @@
+// Package cniallocator implements networkallocator.NetworkAllocator on top
+// of CNI plugin configuration lists instead of libnetwork/CNM drivers. It
+// lets a swarm cluster share the same CNI plugins (bridge, macvlan,
+// host-local, dhcp, ...) used by Kubernetes or podman, rather than
+// depending on libnetwork's driver registry.
+//
+// IPAM is delegated entirely to whichever IPAM plugin a network's conf
+// list declares; this package does not implement its own pool/IP
+// bookkeeping the way cnmallocator's built-in IPAM driver does.
+package cniallocator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/log"
+	"github.com/docker/swarmkit/manager/allocator/networkallocator"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// nodeLocalPluginTypes enumerates the CNI plugin types whose resources
+// (addresses, bridges, interfaces) only have meaning on the host where a
+// container is started. Anything else is treated as swarm-scope and
+// requires the manager to hand out a VIP, matching the CNM notion of
+// global vs. local scope drivers.
+var nodeLocalPluginTypes = map[string]bool{
+	"bridge":  true,
+	"macvlan": true,
+	"ipvlan":  true,
+}
+
+// network is the in-memory state cniAllocator tracks per api.Network.
+type network struct {
+	nw *api.Network
+
+	// confList is the parsed CNI network configuration list used to
+	// invoke the plugin chain for this network.
+	confList *libcni.NetworkConfigList
+
+	// isNodeLocal mirrors cnmallocator's concept of local vs. global
+	// scope: true if any plugin in confList has a node-local type.
+	isNodeLocal bool
+
+	// endpoints maps an allocated address (in CIDR form) to the CNI
+	// ContainerID that was used to request it from the IPAM plugin, so
+	// it can be released symmetrically.
+	endpoints map[string]string
+}
+
+// cniAllocator is the CNI backed implementation of
+// networkallocator.NetworkAllocator.
+type cniAllocator struct {
+	mu sync.Mutex
+
+	// confDir is searched for <network-name>.conflist/.conf files when a
+	// network doesn't carry an inline conf list in its DriverConfig.
+	confDir string
+
+	networks map[string]*network
+	services map[string]struct{}
+	tasks    map[string]struct{}
+	nodes    map[string]struct{}
+}
+
+// New returns a NetworkAllocator backed by CNI plugin configuration lists
+// found under confDir.
+func New(confDir string) (networkallocator.NetworkAllocator, error) {
+	return &cniAllocator{
+		confDir:  confDir,
+		networks: make(map[string]*network),
+		services: make(map[string]struct{}),
+		tasks:    make(map[string]struct{}),
+		nodes:    make(map[string]struct{}),
+	}, nil
+}
+
+// Allocate resolves the CNI conf list for the network and records
+// whether it is node-local or swarm-scope. Swarm-scope networks get an
+// IPAM pool allocated up front so that VIPs and task addresses can be
+// requested from it later.
+func (na *cniAllocator) Allocate(n *api.Network) error {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	if existing, ok := na.networks[n.ID]; ok && existing.nw != nil {
+		return fmt.Errorf("network %s already allocated", n.ID)
+	}
+
+	confList, err := na.resolveConfList(n)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve CNI configuration for network %s", n.ID)
+	}
+
+	nw := &network{
+		nw:          n,
+		confList:    confList,
+		isNodeLocal: isNodeLocal(confList),
+		endpoints:   make(map[string]string),
+	}
+
+	// A restored snapshot may have already created an entry for this
+	// network without an *api.Network attached yet; reuse its recorded
+	// endpoints instead of re-deriving IPAM pool membership.
+	if restored, ok := na.networks[n.ID]; ok {
+		for addr, id := range restored.endpoints {
+			nw.endpoints[addr] = id
+		}
+		na.networks[n.ID] = nw
+		return nil
+	}
+
+	n.DriverState = &api.Driver{
+		Name: confList.Name,
+	}
+
+	if nw.isNodeLocal {
+		// No swarm-level allocation can be provided for node-local
+		// networks; the CNI plugin chain is run at the node, on
+		// container start.
+		n.IPAM = &api.IPAMOptions{Driver: &api.Driver{}}
+	} else {
+		gw, subnet, routes, err := requestPool(confList, n)
+		if err != nil {
+			return errors.Wrapf(err, "failed allocating IPAM pool for network %s", n.ID)
+		}
+		if len(routes) > 0 {
+			n.DriverState.Options = map[string]string{"routes": strings.Join(routes, ",")}
+		}
+		n.IPAM = &api.IPAMOptions{
+			Driver: &api.Driver{Name: "cni"},
+			Configs: []*api.IPAMConfig{
+				{
+					Family:  api.IPAMConfig_IPV4,
+					Subnet:  subnet,
+					Gateway: gw,
+				},
+			},
+		}
+	}
+
+	na.networks[n.ID] = nw
+	return nil
+}
+
+// Deallocate releases the CNI-resolved state for the network.
+func (na *cniAllocator) Deallocate(n *api.Network) error {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	if _, ok := na.networks[n.ID]; !ok {
+		return fmt.Errorf("could not get networker state for network %s", n.ID)
+	}
+
+	delete(na.networks, n.ID)
+	return nil
+}
+
+// ServiceAllocate is a minimal port of cnmallocator's VIP bookkeeping:
+// swarm-scope networks get one VIP allocated from the IPAM plugin, same
+// as overlay networks do with the built-in IPAM driver.
+func (na *cniAllocator) ServiceAllocate(s *api.Service) error {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	if s.Endpoint == nil {
+		s.Endpoint = &api.Endpoint{}
+	}
+	s.Endpoint.Spec = s.Spec.Endpoint.Copy()
+
+	var eVIPs []*api.Endpoint_VirtualIP
+	for _, nAttach := range serviceNetworks(s) {
+		localNet := na.networks[nAttach.Target]
+		if localNet == nil || localNet.isNodeLocal {
+			continue
+		}
+
+		vip := &api.Endpoint_VirtualIP{NetworkID: nAttach.Target}
+		addr, err := na.allocateAddress(localNet, "vip-"+s.ID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to allocate VIP for service %s on network %s", s.ID, nAttach.Target)
+		}
+		vip.Addr = addr
+		eVIPs = append(eVIPs, vip)
+	}
+
+	// Also allocate a VIP on every ingress network relevant to this
+	// service that isn't already covered by its spec networks.
+	if networkallocator.IsIngressNetworkNeeded(s) {
+	ingressLoop:
+		for _, in := range na.selectIngressNetworksLocked(s) {
+			for _, vip := range eVIPs {
+				if vip.NetworkID == in.ID {
+					continue ingressLoop
+				}
+			}
+			localNet := na.networks[in.ID]
+			if localNet == nil || localNet.isNodeLocal {
+				continue
+			}
+			addr, err := na.allocateAddress(localNet, "vip-"+s.ID)
+			if err != nil {
+				return errors.Wrapf(err, "failed to allocate ingress VIP for service %s on network %s", s.ID, in.ID)
+			}
+			eVIPs = append(eVIPs, &api.Endpoint_VirtualIP{NetworkID: in.ID, Addr: addr})
+		}
+	}
+
+	if len(eVIPs) > 0 {
+		na.services[s.ID] = struct{}{}
+	} else {
+		delete(na.services, s.ID)
+	}
+	s.Endpoint.VirtualIPs = eVIPs
+	return nil
+}
+
+// ServiceDeallocate releases the VIPs allocated for the service.
+func (na *cniAllocator) ServiceDeallocate(s *api.Service) error {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	if s.Endpoint == nil {
+		return nil
+	}
+	for _, vip := range s.Endpoint.VirtualIPs {
+		if localNet := na.networks[vip.NetworkID]; localNet != nil {
+			na.releaseAddress(localNet, vip.Addr)
+		}
+	}
+	s.Endpoint.VirtualIPs = nil
+	delete(na.services, s.ID)
+	return nil
+}
+
+// AllocateNode requests an address for the node's network attachment.
+func (na *cniAllocator) AllocateNode(node *api.Node) error {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	if err := na.allocateAttachment(node.Attachment, "node-"+node.ID); err != nil {
+		return err
+	}
+	na.nodes[node.ID] = struct{}{}
+	return nil
+}
+
+// DeallocateNode releases the address allocated to the node's attachment.
+func (na *cniAllocator) DeallocateNode(node *api.Node) error {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	delete(na.nodes, node.ID)
+	na.releaseAttachment(node.Attachment)
+	return nil
+}
+
+// AllocateTask requests an address from the IPAM plugin for every
+// swarm-scope network the task is attached to.
+func (na *cniAllocator) AllocateTask(t *api.Task) error {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	for i, nAttach := range t.Networks {
+		localNet := na.networks[nAttach.Network.ID]
+		if localNet != nil && localNet.isNodeLocal {
+			continue
+		}
+		if err := na.allocateAttachment(nAttach, t.ID); err != nil {
+			for _, rollback := range t.Networks[:i] {
+				na.releaseAttachment(rollback)
+			}
+			return errors.Wrapf(err, "failed to allocate network IP for task %s network %s", t.ID, nAttach.Network.ID)
+		}
+	}
+	na.tasks[t.ID] = struct{}{}
+	return nil
+}
+
+// AllocateTasks is a batched form of AllocateTask. Unlike cnmallocator's
+// version, this stays a plain per-task loop: a CNI IPAM plugin is
+// invoked once per ADD/DEL over its own exec (or dial) transport with no
+// equivalent of a multi-address request, so there is no pool-level RPC
+// to batch here. Each task is still allocated independently; a failure
+// for one task is recorded in failed rather than aborting the rest of
+// the batch.
+func (na *cniAllocator) AllocateTasks(tasks []*api.Task) (allocated []*api.Task, failed map[string]error) {
+	for _, t := range tasks {
+		if err := na.AllocateTask(t); err != nil {
+			if failed == nil {
+				failed = make(map[string]error)
+			}
+			failed[t.ID] = err
+			continue
+		}
+		allocated = append(allocated, t)
+	}
+	return allocated, failed
+}
+
+// DeallocateTask releases all addresses allocated for the task.
+func (na *cniAllocator) DeallocateTask(t *api.Task) error {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	delete(na.tasks, t.ID)
+	for _, nAttach := range t.Networks {
+		na.releaseAttachment(nAttach)
+	}
+	return nil
+}
+
+// IsAllocated returns if the passed network has been allocated or not.
+func (na *cniAllocator) IsAllocated(n *api.Network) bool {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+	_, ok := na.networks[n.ID]
+	return ok
+}
+
+// IsTaskAllocated returns if the passed task has its network resources allocated or not.
+func (na *cniAllocator) IsTaskAllocated(t *api.Task) bool {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	if _, ok := na.tasks[t.ID]; !ok {
+		return false
+	}
+	if len(t.Networks) == 0 {
+		return false
+	}
+	for _, nAttach := range t.Networks {
+		localNet, ok := na.networks[nAttach.Network.ID]
+		if !ok {
+			return false
+		}
+		if localNet.isNodeLocal {
+			continue
+		}
+		if len(nAttach.Addresses) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// IsNodeAllocated returns if the passed node has its network resources allocated or not.
+func (na *cniAllocator) IsNodeAllocated(node *api.Node) bool {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	if _, ok := na.nodes[node.ID]; !ok {
+		return false
+	}
+	if node.Attachment == nil || len(node.Attachment.Addresses) == 0 {
+		return false
+	}
+	_, ok := na.networks[node.Attachment.Network.ID]
+	return ok
+}
+
+// IsServiceAllocated returns true if the passed service doesn't need
+// allocation.
+func (na *cniAllocator) IsServiceAllocated(s *api.Service, flags ...func(*networkallocator.ServiceAllocationOpts)) bool {
+	return !na.ServiceNeedsAllocation(s, flags...)
+}
+
+// HostPublishPortsNeedUpdate is a no-op for the CNI backend: host-mode
+// published ports are not tracked as a swarm-scope resource here since
+// CNI plugins don't expose a port-mapping allocation contract.
+func (na *cniAllocator) HostPublishPortsNeedUpdate(s *api.Service) bool {
+	return false
+}
+
+// ServiceNeedsAllocation returns true if the passed service needs to have
+// network resources allocated/updated. Mirrors cnmallocator's version:
+// a service needs (re)allocation not only when one of its swarm-scope
+// spec networks lacks a VIP, but also when one of the ingress networks
+// relevant to it (per its IngressNetworkLabel, see
+// networkallocator.SelectIngressNetworks) does -- including a service
+// with ingress-mode published ports but no user-defined networks at all.
+func (na *cniAllocator) ServiceNeedsAllocation(s *api.Service, flags ...func(*networkallocator.ServiceAllocationOpts)) bool {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	swarmScopeSpecNets := na.swarmScopeNetworks(serviceNetworks(s))
+
+	var ingressNets []*api.Network
+	if networkallocator.IsIngressNetworkNeeded(s) {
+		ingressNets = networkallocator.SelectIngressNetworks(na.ingressNetworksLocked(), s)
+	}
+
+	if len(swarmScopeSpecNets) == 0 && len(ingressNets) == 0 {
+		return false
+	}
+
+	if _, ok := na.services[s.ID]; !ok {
+		return true
+	}
+	if s.Endpoint == nil || len(s.Endpoint.VirtualIPs) == 0 {
+		return true
+	}
+
+	for _, net := range swarmScopeSpecNets {
+		found := false
+		for _, vip := range s.Endpoint.VirtualIPs {
+			if vip.NetworkID == net.Target {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true
+		}
+	}
+
+	for _, in := range ingressNets {
+		found := false
+		for _, vip := range s.Endpoint.VirtualIPs {
+			if vip.NetworkID == in.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsVIPOnIngressNetwork checks if the vip is in an ingress network.
+func (na *cniAllocator) IsVIPOnIngressNetwork(vip *api.Endpoint_VirtualIP) bool {
+	if vip == nil {
+		return false
+	}
+	na.mu.Lock()
+	localNet := na.networks[vip.NetworkID]
+	na.mu.Unlock()
+	if localNet != nil && localNet.nw != nil {
+		return networkallocator.IsIngressNetwork(localNet.nw)
+	}
+	return false
+}
+
+// IngressNetworks returns every allocated network with Spec.Ingress set
+// (or the legacy "ingress" network).
+func (na *cniAllocator) IngressNetworks() []*api.Network {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+	return na.ingressNetworksLocked()
+}
+
+func (na *cniAllocator) ingressNetworksLocked() []*api.Network {
+	var nets []*api.Network
+	for _, nw := range na.networks {
+		if nw.nw != nil && networkallocator.IsIngressNetwork(nw.nw) {
+			nets = append(nets, nw.nw)
+		}
+	}
+	return nets
+}
+
+// selectIngressNetworksLocked is networkallocator.SelectIngressNetworks
+// applied against this allocator's own IngressNetworks, for callers that
+// already hold na.mu.
+func (na *cniAllocator) selectIngressNetworksLocked(s *api.Service) []*api.Network {
+	return networkallocator.SelectIngressNetworks(na.ingressNetworksLocked(), s)
+}
+
+func (na *cniAllocator) swarmScopeNetworks(attachments []*api.NetworkAttachmentConfig) []*api.NetworkAttachmentConfig {
+	var out []*api.NetworkAttachmentConfig
+	for _, a := range attachments {
+		if localNet := na.networks[a.Target]; localNet != nil && !localNet.isNodeLocal {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func (na *cniAllocator) allocateAttachment(nAttach *api.NetworkAttachment, id string) error {
+	localNet := na.networks[nAttach.Network.ID]
+	if localNet == nil {
+		return fmt.Errorf("could not find network allocator state for network %s", nAttach.Network.ID)
+	}
+	if localNet.isNodeLocal {
+		return nil
+	}
+	addr, err := na.allocateAddress(localNet, id)
+	if err != nil {
+		return err
+	}
+	nAttach.Addresses = []string{addr}
+	return nil
+}
+
+func (na *cniAllocator) releaseAttachment(nAttach *api.NetworkAttachment) {
+	if nAttach == nil || nAttach.Network == nil {
+		return
+	}
+	localNet := na.networks[nAttach.Network.ID]
+	if localNet == nil || localNet.isNodeLocal {
+		return
+	}
+	for _, addr := range nAttach.Addresses {
+		na.releaseAddress(localNet, addr)
+	}
+	nAttach.Addresses = nil
+}
+
+// allocateAddress delegates an address request to the IPAM plugin
+// declared in the network's conf list, keyed by a per-caller id so the
+// corresponding DEL can be issued symmetrically.
+func (na *cniAllocator) allocateAddress(localNet *network, id string) (string, error) {
+	result, err := execIPAMAdd(context.TODO(), localNet.confList, id)
+	if err != nil {
+		return "", errors.Wrap(err, "could not allocate address from CNI IPAM plugin")
+	}
+	localNet.endpoints[result.Address] = id
+	return result.Address, nil
+}
+
+func (na *cniAllocator) releaseAddress(localNet *network, addr string) {
+	id, ok := localNet.endpoints[addr]
+	if !ok {
+		return
+	}
+	delete(localNet.endpoints, addr)
+	if err := execIPAMDel(context.TODO(), localNet.confList, id); err != nil {
+		log.G(context.TODO()).WithError(err).Errorf("CNI IPAM failure while releasing address %s", addr)
+	}
+}
+
+// resolveConfList loads the network's CNI configuration list, either
+// inline from DriverConfig.Options["com.docker.network.cni.conflist"] or
+// by name from confDir.
+func (na *cniAllocator) resolveConfList(n *api.Network) (*libcni.NetworkConfigList, error) {
+	name := n.Spec.Annotations.Name
+	if n.Spec.DriverConfig != nil && n.Spec.DriverConfig.Name != "" {
+		name = n.Spec.DriverConfig.Name
+	}
+	if n.Spec.DriverConfig != nil {
+		if inline, ok := n.Spec.DriverConfig.Options["com.docker.network.cni.conflist"]; ok {
+			return libcni.ConfListFromBytes([]byte(inline))
+		}
+	}
+	return libcni.LoadConfList(na.confDir, name)
+}
+
+func isNodeLocal(confList *libcni.NetworkConfigList) bool {
+	for _, plugin := range confList.Plugins {
+		if nodeLocalPluginTypes[plugin.Network.Type] {
+			return true
+		}
+	}
+	return false
+}
+
+func serviceNetworks(s *api.Service) []*api.NetworkAttachmentConfig {
+	if len(s.Spec.Task.Networks) == 0 && len(s.Spec.Networks) != 0 {
+		return s.Spec.Networks
+	}
+	return s.Spec.Task.Networks
+}
+
+// requestPool asks the CNI IPAM plugin declared in confList for a
+// network-wide subnet, gateway, and routes. CNI's IPAM contract is
+// per-container rather than per-pool, so we synthesize this by issuing a
+// single probe ADD against a sentinel container ID: the subnet comes
+// from the host prefix of the address the plugin hands back, but the
+// gateway and routes are taken from the plugin's own reported values
+// rather than the probe address itself, which is just a throwaway lease
+// immediately released below.
+func requestPool(confList *libcni.NetworkConfigList, n *api.Network) (gateway, subnet string, routes []string, err error) {
+	id := "pool-" + n.ID
+	result, err := execIPAMAdd(context.TODO(), confList, id)
+	if err != nil {
+		return "", "", nil, err
+	}
+	_, ipnet, err := net.ParseCIDR(result.Address)
+	if err != nil {
+		return "", "", nil, err
+	}
+	_ = execIPAMDel(context.TODO(), confList, id)
+
+	gw := result.Gateway
+	if gw == "" {
+		gw = firstUsableAddress(ipnet).String()
+	}
+
+	return gw, ipnet.String(), result.Routes, nil
+}
+
+// firstUsableAddress returns the first address past the network address of
+// ipnet, used as the fallback gateway for IPAM plugins (e.g. a bare
+// host-local conf with no "gateway" option) that don't report one
+// themselves, matching host-local's own default gateway behavior.
+func firstUsableAddress(ipnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(ipnet.IP))
+	copy(ip, ipnet.IP)
+	ip[len(ip)-1]++
+	return ip
+}
@@ -0,0 +1,130 @@
+package cniallocator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"golang.org/x/net/context"
+)
+
+// ipamType returns the IPAM plugin type declared by the first plugin in
+// the conf list that carries one, along with the raw conf bytes naming
+// it. A conf list with no IPAM section (e.g. a bare node-local bridge
+// conf) has no pool to request from.
+func ipamType(confList *libcni.NetworkConfigList) (string, []byte, error) {
+	for _, plugin := range confList.Plugins {
+		var raw struct {
+			IPAM struct {
+				Type string `json:"type"`
+			} `json:"ipam"`
+		}
+		if err := json.Unmarshal(plugin.Bytes, &raw); err != nil {
+			return "", nil, err
+		}
+		if raw.IPAM.Type != "" {
+			return raw.IPAM.Type, plugin.Bytes, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no IPAM plugin declared in CNI conf list %s", confList.Name)
+}
+
+// ipamOnlyConfigList wraps confList's IPAM plugin conf as a single-plugin
+// libcni.NetworkConfigList, so it can be driven through libcni's normal
+// AddNetworkList/DelNetworkList entry points without also running the
+// network plugins (bridge, macvlan, ...) ahead of it in confList -- the
+// manager only ever needs the IPAM plugin's reservation, never to build
+// an actual interface.
+func ipamOnlyConfigList(confList *libcni.NetworkConfigList) (*libcni.NetworkConfigList, error) {
+	ipamType, netConf, err := ipamType(confList)
+	if err != nil {
+		return nil, err
+	}
+	return &libcni.NetworkConfigList{
+		Name: confList.Name,
+		Plugins: []*libcni.NetworkConfig{
+			{Network: &types.NetConf{Type: ipamType}, Bytes: netConf},
+		},
+	}, nil
+}
+
+// cniConfig returns a libcni.CNIConfig that looks up plugin binaries on
+// CNI_PATH, matching how the rest of the CNI ecosystem locates them.
+func cniConfig() *libcni.CNIConfig {
+	return libcni.NewCNIConfig(filepath.SplitList(os.Getenv("CNI_PATH")), nil)
+}
+
+// runtimeConf builds the per-call identity an IPAM plugin keys its
+// idempotent ADD/DEL reservations by (e.g. host-local keys leases on
+// ContainerID+IfName). The manager never creates an actual network
+// namespace or interface for these calls -- it only ever talks to the
+// IPAM plugin -- so NetNS/IfName are fixed placeholders; id is what
+// actually has to be distinct per caller (a VIP, task, node attachment,
+// or pool probe) so concurrent allocations don't collide on one lease.
+func runtimeConf(id string) *libcni.RuntimeConf {
+	return &libcni.RuntimeConf{
+		ContainerID: id,
+		NetNS:       "/var/run/docker/netns/swarmkit-allocator",
+		IfName:      "swarm0",
+	}
+}
+
+// ipamAddResult is everything the manager keeps from a CNI IPAM ADD: the
+// assigned address in CIDR form, plus the plugin's own gateway and
+// routes for that address, so callers don't have to fall back to
+// synthesizing a fake gateway from the address itself.
+type ipamAddResult struct {
+	Address string
+	Gateway string
+	Routes  []string
+}
+
+// execIPAMAdd invokes the IPAM plugin declared by confList for id,
+// returning the assigned address along with the gateway and routes the
+// plugin reported for it.
+func execIPAMAdd(ctx context.Context, confList *libcni.NetworkConfigList, id string) (ipamAddResult, error) {
+	ipamList, err := ipamOnlyConfigList(confList)
+	if err != nil {
+		return ipamAddResult{}, err
+	}
+
+	result, err := cniConfig().AddNetworkList(ctx, ipamList, runtimeConf(id))
+	if err != nil {
+		return ipamAddResult{}, err
+	}
+
+	ipamResult, err := current.NewResultFromResult(result)
+	if err != nil {
+		return ipamAddResult{}, err
+	}
+	if len(ipamResult.IPs) == 0 {
+		return ipamAddResult{}, fmt.Errorf("IPAM plugin %s returned no addresses", ipamList.Plugins[0].Network.Type)
+	}
+
+	ip := ipamResult.IPs[0]
+	add := ipamAddResult{Address: ip.Address.String()}
+	if ip.Gateway != nil {
+		add.Gateway = ip.Gateway.String()
+	}
+	for _, route := range ipamResult.Routes {
+		if route == nil {
+			continue
+		}
+		add.Routes = append(add.Routes, route.Dst.String())
+	}
+
+	return add, nil
+}
+
+// execIPAMDel releases the address previously allocated to id.
+func execIPAMDel(ctx context.Context, confList *libcni.NetworkConfigList, id string) error {
+	ipamList, err := ipamOnlyConfigList(confList)
+	if err != nil {
+		return err
+	}
+	return cniConfig().DelNetworkList(ctx, ipamList, runtimeConf(id))
+}
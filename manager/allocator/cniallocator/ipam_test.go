@@ -0,0 +1,31 @@
+package cniallocator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFirstUsableAddress(t *testing.T) {
+	cases := []struct {
+		name string
+		cidr string
+		want string
+	}{
+		{name: "v4", cidr: "10.0.0.0/24", want: "10.0.0.1"},
+		{name: "v4 non-zero host bits", cidr: "192.168.1.5/24", want: "192.168.1.1"},
+		{name: "v6", cidr: "fd00::/64", want: "fd00::1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, ipnet, err := net.ParseCIDR(c.cidr)
+			if err != nil {
+				t.Fatalf("ParseCIDR(%s): %v", c.cidr, err)
+			}
+			got := firstUsableAddress(ipnet)
+			if got.String() != c.want {
+				t.Errorf("firstUsableAddress(%s) = %s, want %s", c.cidr, got, c.want)
+			}
+		})
+	}
+}
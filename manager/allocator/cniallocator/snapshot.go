@@ -0,0 +1,72 @@
+package cniallocator
+
+import (
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/manager/allocator/networkallocator"
+)
+
+// Snapshot returns a serializable copy of the allocator's endpoint
+// bookkeeping. The CNI backend has no pool concept of its own -- IPAM is
+// delegated entirely to the plugin declared in each network's conf list
+// -- so NetworkSnapshot.Pools is always left empty.
+func (na *cniAllocator) Snapshot() (*networkallocator.Snapshot, error) {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	snap := networkallocator.NewSnapshot()
+	for id, nw := range na.networks {
+		ns := networkallocator.NetworkSnapshot{
+			IsNodeLocal: nw.isNodeLocal,
+			Endpoints:   make(map[string]string, len(nw.endpoints)),
+		}
+		for addr, cniID := range nw.endpoints {
+			ns.Endpoints[addr] = cniID
+		}
+		snap.Networks[id] = ns
+	}
+	for id := range na.services {
+		snap.Services[id] = struct{}{}
+	}
+	for id := range na.tasks {
+		snap.Tasks[id] = struct{}{}
+	}
+	for id := range na.nodes {
+		snap.Nodes[id] = struct{}{}
+	}
+	return snap, nil
+}
+
+// Restore rehydrates na's in-memory state from a previously taken
+// Snapshot. As with cnmallocator, network objects still need to flow
+// through Allocate to resolve their CNI conf list; doing so for a
+// network ID already present from Restore reuses the recorded endpoints
+// rather than re-deriving them.
+func (na *cniAllocator) Restore(snap *networkallocator.Snapshot) error {
+	if snap == nil {
+		return nil
+	}
+
+	na.mu.Lock()
+	defer na.mu.Unlock()
+
+	for id, ns := range snap.Networks {
+		nw := &network{
+			isNodeLocal: ns.IsNodeLocal,
+			endpoints:   make(map[string]string, len(ns.Endpoints)),
+		}
+		for addr, cniID := range ns.Endpoints {
+			nw.endpoints[addr] = cniID
+		}
+		na.networks[id] = nw
+	}
+	for id := range snap.Services {
+		na.services[id] = struct{}{}
+	}
+	for id := range snap.Tasks {
+		na.tasks[id] = struct{}{}
+	}
+	for id := range snap.Nodes {
+		na.nodes[id] = struct{}{}
+	}
+	return nil
+}
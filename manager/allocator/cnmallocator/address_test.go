@@ -0,0 +1,68 @@
+package cnmallocator
+
+import (
+	"net"
+	"testing"
+
+	"github.com/docker/swarmkit/api"
+)
+
+func TestParseAllocAddr(t *testing.T) {
+	cases := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", raw: "", want: ""},
+		{name: "v4 CIDR", raw: "10.0.0.5/24", want: "10.0.0.5"},
+		{name: "v4 bare", raw: "10.0.0.5", want: "10.0.0.5"},
+		{name: "v6 CIDR", raw: "fd00::5/64", want: "fd00::5"},
+		{name: "v6 bare", raw: "fd00::5", want: "fd00::5"},
+		{name: "garbage", raw: "not-an-address", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseAllocAddr(c.raw)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("parseAllocAddr(%q) = %v, nil, want an error", c.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAllocAddr(%q) returned error: %v", c.raw, err)
+			}
+			if c.want == "" {
+				if got != nil {
+					t.Fatalf("parseAllocAddr(%q) = %v, want nil", c.raw, got)
+				}
+				return
+			}
+			if got.String() != c.want {
+				t.Fatalf("parseAllocAddr(%q) = %v, want %s", c.raw, got, c.want)
+			}
+		})
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	cases := []struct {
+		name string
+		addr net.IP
+		want api.IPAMConfig_Family
+	}{
+		{name: "nil defaults to v4", addr: nil, want: api.IPAMConfig_IPV4},
+		{name: "v4", addr: net.ParseIP("10.0.0.5"), want: api.IPAMConfig_IPV4},
+		{name: "v6", addr: net.ParseIP("fd00::5"), want: api.IPAMConfig_IPV6},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := addressFamily(c.addr); got != c.want {
+				t.Errorf("addressFamily(%v) = %v, want %v", c.addr, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1436 @@
+// Package cnmallocator provides the libnetwork/CNM backed implementation
+// of networkallocator.NetworkAllocator. It is the only place in swarmkit
+// that imports libnetwork's drvregistry/ipamapi/driverapi packages; the
+// rest of the manager only ever talks to the networkallocator.NetworkAllocator
+// interface, so alternate backends (see manager/allocator/cniallocator)
+// can be swapped in without pulling in this package's dependencies.
+package cnmallocator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/docker/pkg/plugingetter"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/docker/libnetwork/driverapi"
+	"github.com/docker/libnetwork/drvregistry"
+	"github.com/docker/libnetwork/ipamapi"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/log"
+	"github.com/docker/swarmkit/manager/allocator/networkallocator"
+	"github.com/docker/swarmkit/node/plugin"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultDriver defines the name of the driver to be used by
+	// default if a network without any driver name specified is
+	// created.
+	DefaultDriver = "overlay"
+)
+
+// familyOrder fixes the order in which addresses are requested/returned
+// for a dual-stack network attachment, so callers can rely on
+// nAttach.Addresses[0] being the v4 address when both are present.
+var familyOrder = []api.IPAMConfig_Family{api.IPAMConfig_IPV4, api.IPAMConfig_IPV6}
+
+// cnmNetAllocator acts as the controller for all network related operations
+// like managing network and IPAM drivers and also creating and
+// deleting networks and the associated resources.
+type cnmNetAllocator struct {
+	// The driver register which manages all internal and external
+	// IPAM and network drivers.
+	drvRegistry *drvregistry.DrvRegistry
+
+	// The port allocator instance for allocating node ports
+	portAllocator *portAllocator
+
+	// Local network state used by NetworkAllocator to do network management.
+	networks map[string]*network
+
+	// Allocator state to indicate if allocation has been
+	// successfully completed for this service.
+	services map[string]struct{}
+
+	// Allocator state to indicate if allocation has been
+	// successfully completed for this task.
+	tasks map[string]struct{}
+
+	// Allocator state to indicate if allocation has been
+	// successfully completed for this node.
+	nodes map[string]struct{}
+}
+
+// Local in-memory state related to network that need to be tracked by cnmNetAllocator
+type network struct {
+	// A local cache of the store object.
+	nw *api.Network
+
+	// pools is used to save the internal poolIDs needed when
+	// releasing the pool, keyed by address family so that a
+	// dual-stack network can hand out both a v4 and a v6 address.
+	pools map[api.IPAMConfig_Family]map[string]string
+
+	// endpoints is a map of endpoint IP to the poolID from which it
+	// was allocated.
+	endpoints map[string]string
+
+	// isNodeLocal indicates whether the scope of the network's resources
+	// is local to the node. If true, it means the resources can only be
+	// allocated locally by the node where the network will be deployed.
+	// In this the swarm manager will skip the allocations.
+	isNodeLocal bool
+}
+
+type networkDriver struct {
+	driver     driverapi.Driver
+	name       string
+	capability *driverapi.Capability
+}
+
+type initializer struct {
+	fn    drvregistry.InitFunc
+	ntype string
+}
+
+// New returns a new NetworkAllocator handle backed by libnetwork/CNM
+// drivers. pg is used, if non-nil, to discover remote network and IPAM
+// drivers registered as engine plugins -- including third-party IPAM
+// drivers activated through initIPAMDrivers' remote registration -- so
+// that swarmkit itself never has to import moby's pkg/plugingetter; see
+// AdaptPluginGetter for converting a moby pkg/plugingetter.PluginGetter
+// into the plugin.Getter this package expects. cfg may be nil, in which
+// case the built-in IPAM driver's compiled-in default address pools are
+// used unmodified.
+func New(pg plugin.Getter, cfg *networkallocator.Config) (networkallocator.NetworkAllocator, error) {
+	na := &cnmNetAllocator{
+		networks: make(map[string]*network),
+		services: make(map[string]struct{}),
+		tasks:    make(map[string]struct{}),
+		nodes:    make(map[string]struct{}),
+	}
+
+	if cfg != nil && len(cfg.DefaultAddrPool) > 0 {
+		if err := configureDefaultAddressPools(cfg); err != nil {
+			return nil, errors.Wrap(err, "failed to configure default address pools")
+		}
+	}
+
+	// There are no driver configurations and notification
+	// functions as of now.
+	reg, err := drvregistry.New(nil, nil, nil, nil, newPluginGetterShim(pg))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := initializeDrivers(reg); err != nil {
+		return nil, err
+	}
+
+	if err = initIPAMDrivers(reg); err != nil {
+		return nil, err
+	}
+
+	pa, err := newPortAllocator()
+	if err != nil {
+		return nil, err
+	}
+
+	na.portAllocator = pa
+	na.drvRegistry = reg
+	return na, nil
+}
+
+// Allocate allocates all the necessary resources both general
+// and driver-specific which may be specified in the NetworkSpec
+func (na *cnmNetAllocator) Allocate(n *api.Network) error {
+	// A restored snapshot may have already created an entry for this
+	// network without an *api.Network attached yet (see Restore); in
+	// that case finish populating it instead of treating it as a
+	// duplicate allocation.
+	if existing, ok := na.networks[n.ID]; ok && existing.nw != nil {
+		return fmt.Errorf("network %s already allocated", n.ID)
+	}
+
+	d, err := na.resolveDriver(n)
+	if err != nil {
+		return err
+	}
+
+	nw := &network{
+		nw:          n,
+		endpoints:   make(map[string]string),
+		isNodeLocal: d.capability.DataScope == datastore.LocalScope,
+	}
+
+	if restored, ok := na.networks[n.ID]; ok {
+		nw.pools = restored.pools
+		for addr, poolID := range restored.endpoints {
+			nw.endpoints[addr] = poolID
+		}
+		na.networks[n.ID] = nw
+		return nil
+	}
+
+	// No swarm-level allocation can be provided by the network driver for
+	// node-local networks. Only thing needed is populating the driver's name
+	// in the driver's state.
+	if nw.isNodeLocal {
+		n.DriverState = &api.Driver{
+			Name: d.name,
+		}
+		// In order to support backward compatibility with older daemon
+		// versions which assumes the network attachment to contains
+		// non nil IPAM attribute, passing an empty object
+		n.IPAM = &api.IPAMOptions{Driver: &api.Driver{}}
+	} else {
+		nw.pools, err = na.allocatePools(n)
+		if err != nil {
+			return errors.Wrapf(err, "failed allocating pools and gateway IP for network %s", n.ID)
+		}
+
+		if err := na.allocateDriverState(n); err != nil {
+			na.freePools(n, nw.pools)
+			return errors.Wrapf(err, "failed while allocating driver state for network %s", n.ID)
+		}
+	}
+
+	na.networks[n.ID] = nw
+
+	return nil
+}
+
+func (na *cnmNetAllocator) getNetwork(id string) *network {
+	return na.networks[id]
+}
+
+// Deallocate frees all the general and driver specific resources
+// which were assigned to the passed network.
+func (na *cnmNetAllocator) Deallocate(n *api.Network) error {
+	localNet := na.getNetwork(n.ID)
+	if localNet == nil {
+		return fmt.Errorf("could not get networker state for network %s", n.ID)
+	}
+
+	// No swarm-level resource deallocation needed for node-local networks
+	if localNet.isNodeLocal {
+		delete(na.networks, n.ID)
+		return nil
+	}
+
+	if err := na.freeDriverState(n); err != nil {
+		return errors.Wrapf(err, "failed to free driver state for network %s", n.ID)
+	}
+
+	delete(na.networks, n.ID)
+
+	return na.freePools(n, localNet.pools)
+}
+
+// ServiceAllocate allocates all the network resources such as virtual
+// IP and ports needed by the service.
+func (na *cnmNetAllocator) ServiceAllocate(s *api.Service) (err error) {
+	if err = na.portAllocator.serviceAllocatePorts(s); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			na.ServiceDeallocate(s)
+		}
+	}()
+
+	if s.Endpoint == nil {
+		s.Endpoint = &api.Endpoint{}
+	}
+	s.Endpoint.Spec = s.Spec.Endpoint.Copy()
+
+	// If ResolutionMode is DNSRR do not try allocating VIPs, but
+	// free any VIP from previous state.
+	if s.Spec.Endpoint != nil && s.Spec.Endpoint.Mode == api.ResolutionModeDNSRoundRobin {
+		for _, vip := range s.Endpoint.VirtualIPs {
+			if err := na.deallocateVIP(vip); err != nil {
+				// don't bail here, deallocate as many as possible.
+				log.L.WithError(err).
+					WithField("vip.network", vip.NetworkID).
+					WithField("vip.addr", vip.Addr).Error("error deallocating vip")
+			}
+		}
+
+		s.Endpoint.VirtualIPs = nil
+
+		delete(na.services, s.ID)
+		return nil
+	}
+
+	specNetworks := serviceNetworks(s)
+
+	// Resolve which ingress network(s), if any, this service's
+	// ingress-mode published ports should get a VIP on. A cluster may
+	// run more than one ingress network, so this is no longer assumed
+	// to be a single global network.
+	var ingressNets []*api.Network
+	if networkallocator.IsIngressNetworkNeeded(s) {
+		ingressNets = networkallocator.SelectIngressNetworks(na.IngressNetworks(), s)
+	}
+	isRelevantIngress := func(networkID string) bool {
+		for _, nw := range ingressNets {
+			if nw.ID == networkID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Allocate VIPs for all the pre-populated endpoint attachments
+	eVIPs := s.Endpoint.VirtualIPs[:0]
+
+vipLoop:
+	for _, eAttach := range s.Endpoint.VirtualIPs {
+		if isRelevantIngress(eAttach.NetworkID) {
+			if err = na.allocateVIP(eAttach); err != nil {
+				return err
+			}
+			eVIPs = append(eVIPs, eAttach)
+			continue vipLoop
+
+		}
+		for _, nAttach := range specNetworks {
+			if nAttach.Target == eAttach.NetworkID {
+				if err = na.allocateVIP(eAttach); err != nil {
+					return err
+				}
+				eVIPs = append(eVIPs, eAttach)
+				continue vipLoop
+			}
+		}
+		// If the network of the VIP is not part of the service spec nor
+		// one of the currently relevant ingress networks, deallocate it.
+		na.deallocateVIP(eAttach)
+	}
+
+networkLoop:
+	for _, nAttach := range specNetworks {
+		for _, vip := range eVIPs {
+			if vip.NetworkID == nAttach.Target {
+				continue networkLoop
+			}
+		}
+
+		vip := &api.Endpoint_VirtualIP{NetworkID: nAttach.Target}
+		if err = na.allocateVIP(vip); err != nil {
+			return err
+		}
+
+		eVIPs = append(eVIPs, vip)
+	}
+
+	// Make sure every relevant ingress network has a VIP, even one that
+	// isn't otherwise part of the service's spec networks.
+ingressLoop:
+	for _, in := range ingressNets {
+		for _, vip := range eVIPs {
+			if vip.NetworkID == in.ID {
+				continue ingressLoop
+			}
+		}
+
+		vip := &api.Endpoint_VirtualIP{NetworkID: in.ID}
+		if err = na.allocateVIP(vip); err != nil {
+			return err
+		}
+
+		eVIPs = append(eVIPs, vip)
+	}
+
+	if len(eVIPs) > 0 {
+		na.services[s.ID] = struct{}{}
+	} else {
+		delete(na.services, s.ID)
+	}
+
+	s.Endpoint.VirtualIPs = eVIPs
+	return nil
+}
+
+// ServiceDeallocate de-allocates all the network resources such as
+// virtual IP and ports associated with the service.
+func (na *cnmNetAllocator) ServiceDeallocate(s *api.Service) error {
+	if s.Endpoint == nil {
+		return nil
+	}
+
+	for _, vip := range s.Endpoint.VirtualIPs {
+		if err := na.deallocateVIP(vip); err != nil {
+			// don't bail here, deallocate as many as possible.
+			log.L.WithError(err).
+				WithField("vip.network", vip.NetworkID).
+				WithField("vip.addr", vip.Addr).Error("error deallocating vip")
+		}
+	}
+	s.Endpoint.VirtualIPs = nil
+
+	na.portAllocator.serviceDeallocatePorts(s)
+	delete(na.services, s.ID)
+
+	return nil
+}
+
+// IsAllocated returns if the passed network has been allocated or not.
+func (na *cnmNetAllocator) IsAllocated(n *api.Network) bool {
+	_, ok := na.networks[n.ID]
+	return ok
+}
+
+// IsTaskAllocated returns if the passed task has its network resources allocated or not.
+func (na *cnmNetAllocator) IsTaskAllocated(t *api.Task) bool {
+	// If the task is not found in the allocated set, then it is
+	// not allocated.
+	if _, ok := na.tasks[t.ID]; !ok {
+		return false
+	}
+
+	// If Networks is empty there is no way this Task is allocated.
+	if len(t.Networks) == 0 {
+		return false
+	}
+
+	// To determine whether the task has its resources allocated,
+	// we just need to look at one global scope network (in case of
+	// multi-network attachment).  This is because we make sure we
+	// allocate for every network or we allocate for none.
+
+	// Find the first global scope network
+	for _, nAttach := range t.Networks {
+		// If the network is not allocated, the task cannot be allocated.
+		localNet, ok := na.networks[nAttach.Network.ID]
+		if !ok {
+			return false
+		}
+
+		// Nothing else to check for local scope network
+		if localNet.isNodeLocal {
+			continue
+		}
+
+		// Addresses empty. Task is not allocated.
+		if len(nAttach.Addresses) == 0 {
+			return false
+		}
+
+		// The allocated IP address not found in local endpoint state. Not allocated.
+		if _, ok := localNet.endpoints[nAttach.Addresses[0]]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsServiceAllocated returns true if the passed service doesn't need
+// allocation.
+func (na *cnmNetAllocator) IsServiceAllocated(s *api.Service, flags ...func(*networkallocator.ServiceAllocationOpts)) bool {
+	return !na.ServiceNeedsAllocation(s, flags...)
+}
+
+// HostPublishPortsNeedUpdate returns true if the passed service needs
+// allocations for its published ports in host (non ingress) mode
+func (na *cnmNetAllocator) HostPublishPortsNeedUpdate(s *api.Service) bool {
+	return na.portAllocator.hostPublishPortsNeedUpdate(s)
+}
+
+// ServiceNeedsAllocation returns true if the passed service needs to have network resources allocated/updated.
+func (na *cnmNetAllocator) ServiceNeedsAllocation(s *api.Service, flags ...func(*networkallocator.ServiceAllocationOpts)) bool {
+	var options networkallocator.ServiceAllocationOpts
+	for _, flag := range flags {
+		flag(&options)
+	}
+
+	specNetworks := serviceNetworks(s)
+
+	// If endpoint mode is VIP and allocator does not have the
+	// service in VIP allocated set then it needs to be allocated.
+	if len(specNetworks) != 0 &&
+		(s.Spec.Endpoint == nil ||
+			s.Spec.Endpoint.Mode == api.ResolutionModeVirtualIP) {
+
+		if _, ok := na.services[s.ID]; !ok {
+			return true
+		}
+
+		if s.Endpoint == nil || len(s.Endpoint.VirtualIPs) == 0 {
+			return true
+		}
+
+		// If the spec has networks which don't have a corresponding VIP,
+		// the service needs to be allocated.
+	networkLoop:
+		for _, net := range specNetworks {
+			for _, vip := range s.Endpoint.VirtualIPs {
+				if vip.NetworkID == net.Target {
+					continue networkLoop
+				}
+			}
+			return true
+		}
+	}
+
+	// If the spec no longer has networks attached and has a vip allocated
+	// from previous spec the service needs to allocated.
+	if s.Endpoint != nil {
+		var ingressNets []*api.Network
+		if networkallocator.IsIngressNetworkNeeded(s) {
+			ingressNets = networkallocator.SelectIngressNetworks(na.IngressNetworks(), s)
+		}
+
+	vipLoop:
+		for _, vip := range s.Endpoint.VirtualIPs {
+			for _, in := range ingressNets {
+				if vip.NetworkID == in.ID {
+					continue vipLoop
+				}
+			}
+			for _, net := range specNetworks {
+				if vip.NetworkID == net.Target {
+					continue vipLoop
+				}
+			}
+			return true
+		}
+
+		// Conversely, if one of the currently relevant ingress networks
+		// has no corresponding VIP yet, the service needs (re)allocation.
+		for _, in := range ingressNets {
+			found := false
+			for _, vip := range s.Endpoint.VirtualIPs {
+				if vip.NetworkID == in.ID {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return true
+			}
+		}
+	}
+
+	// If the endpoint mode is DNSRR and allocator has the service
+	// in VIP allocated set then we return to be allocated to make
+	// sure the allocator triggers networkallocator to free up the
+	// resources if any.
+	if s.Spec.Endpoint != nil && s.Spec.Endpoint.Mode == api.ResolutionModeDNSRoundRobin {
+		if _, ok := na.services[s.ID]; ok {
+			return true
+		}
+	}
+
+	if (s.Spec.Endpoint != nil && len(s.Spec.Endpoint.Ports) != 0) ||
+		(s.Endpoint != nil && len(s.Endpoint.Ports) != 0) {
+		return !na.portAllocator.isPortsAllocatedOnInit(s, options.OnInit)
+	}
+	return false
+}
+
+// IsNodeAllocated returns if the passed node has its network resources allocated or not.
+func (na *cnmNetAllocator) IsNodeAllocated(node *api.Node) bool {
+	// If the node is not found in the allocated set, then it is
+	// not allocated.
+	if _, ok := na.nodes[node.ID]; !ok {
+		return false
+	}
+
+	// If no attachment, not allocated.
+	if node.Attachment == nil {
+		return false
+	}
+
+	// If the network is not allocated, the node cannot be allocated.
+	localNet, ok := na.networks[node.Attachment.Network.ID]
+	if !ok {
+		return false
+	}
+
+	// Addresses empty, not allocated.
+	if len(node.Attachment.Addresses) == 0 {
+		return false
+	}
+
+	// The allocated IP address not found in local endpoint state. Not allocated.
+	if _, ok := localNet.endpoints[node.Attachment.Addresses[0]]; !ok {
+		return false
+	}
+
+	return true
+}
+
+// AllocateNode allocates the IP addresses for the network to which
+// the node is attached.
+func (na *cnmNetAllocator) AllocateNode(node *api.Node) error {
+	if err := na.allocateNetworkIPs(node.Attachment); err != nil {
+		return err
+	}
+
+	na.nodes[node.ID] = struct{}{}
+	return nil
+}
+
+// DeallocateNode deallocates the IP addresses for the network to
+// which the node is attached.
+func (na *cnmNetAllocator) DeallocateNode(node *api.Node) error {
+	delete(na.nodes, node.ID)
+	return na.releaseEndpoints([]*api.NetworkAttachment{node.Attachment})
+}
+
+// AllocateTask allocates all the endpoint resources for all the
+// networks that a task is attached to.
+func (na *cnmNetAllocator) AllocateTask(t *api.Task) error {
+	for i, nAttach := range t.Networks {
+		if localNet := na.getNetwork(nAttach.Network.ID); localNet != nil && localNet.isNodeLocal {
+			continue
+		}
+		if err := na.allocateNetworkIPs(nAttach); err != nil {
+			if err := na.releaseEndpoints(t.Networks[:i]); err != nil {
+				log.G(context.TODO()).WithError(err).Errorf("Failed to release IP addresses while rolling back allocation for task %s network %s", t.ID, nAttach.Network.ID)
+			}
+			return errors.Wrapf(err, "failed to allocate network IP for task %s network %s", t.ID, nAttach.Network.ID)
+		}
+	}
+
+	na.tasks[t.ID] = struct{}{}
+
+	return nil
+}
+
+// batchAddressRequester is an optional capability an IPAM driver may
+// implement to hand back many addresses from one pool in a single call.
+// AllocateTasks probes for it so a large scale-up can request every
+// address a pool owes the batch in one round trip instead of one
+// RequestAddress call per task; drivers that don't implement it (which
+// is every built-in driver today) fall through to the existing per-task
+// RequestAddress loop.
+type batchAddressRequester interface {
+	BatchRequestAddress(poolID string, num int, opts map[string]string) ([]net.IP, error)
+}
+
+// taskAttach identifies one task's attachment to a network, so a group
+// of them spanning several tasks can be resolved against a single pool.
+type taskAttach struct {
+	task    *api.Task
+	nAttach *api.NetworkAttachment
+}
+
+// groupKey groups a batch of pending task network attachments in
+// AllocateTasks by network and address family. A group is resolved
+// against every pool of that family on the network, not a single pool.
+type groupKey struct {
+	networkID string
+	family    api.IPAMConfig_Family
+}
+
+// orderedGroupKeys returns groups' keys ordered by familyOrder, so a caller
+// appending addresses to a shared nAttach.Addresses across several groups
+// processes every IPV4 group before any IPV6 group. Without this, ranging
+// groups directly would do so in Go's randomized map order: a dual-stack
+// attachment has an entry in both the IPV4 and IPV6 groups, and whichever
+// happened to be processed first would win the race to append its address
+// first, scrambling the v4-before-v6 ordering every other allocator path
+// relies on. Keys within the same family are not otherwise ordered, since
+// nothing depends on the order networks within a family are processed in.
+func orderedGroupKeys(groups map[groupKey][]taskAttach) []groupKey {
+	keys := make([]groupKey, 0, len(groups))
+	for _, family := range familyOrder {
+		for key := range groups {
+			if key.family == family {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// AllocateTasks is a batched form of AllocateTask. Pending attachments
+// across every task are grouped by (networkID, family) so each group is
+// handled in one pass -- via batchAddressRequester when the
+// resolved IPAM driver supports it, or the ordinary per-attachment
+// RequestAddress loop otherwise -- rather than walking AllocateTask once
+// per task. A task that can't have all of its attachments satisfied has
+// just its own partially-allocated endpoints rolled back and is recorded
+// in failed, rather than aborting the whole batch.
+//
+// A task that already carries addresses on one of its attachments (the
+// restore-from-store path, where the specific address must be
+// re-requested rather than any free one handed out) is allocated through
+// the plain AllocateTask instead, since that re-request is keyed on the
+// existing address, not a poolable batch request.
+func (na *cnmNetAllocator) AllocateTasks(tasks []*api.Task) (allocated []*api.Task, failed map[string]error) {
+	fail := func(t *api.Task, err error) {
+		if failed == nil {
+			failed = make(map[string]error)
+		}
+		failed[t.ID] = err
+	}
+
+	var batchable []*api.Task
+	for _, t := range tasks {
+		restore := false
+		for _, nAttach := range t.Networks {
+			if len(nAttach.Addresses) > 0 {
+				restore = true
+				break
+			}
+		}
+		if !restore {
+			batchable = append(batchable, t)
+			continue
+		}
+		if err := na.AllocateTask(t); err != nil {
+			fail(t, err)
+			continue
+		}
+		allocated = append(allocated, t)
+	}
+	tasks = batchable
+
+	groups := make(map[groupKey][]taskAttach)
+	taskErr := make(map[string]error)
+	touched := make(map[string][]*api.NetworkAttachment)
+
+	for _, t := range tasks {
+		for _, nAttach := range t.Networks {
+			if len(nAttach.Addresses) > 0 {
+				continue
+			}
+			localNet := na.getNetwork(nAttach.Network.ID)
+			if localNet == nil {
+				taskErr[t.ID] = fmt.Errorf("could not find network allocator state for network %s", nAttach.Network.ID)
+				break
+			}
+			if localNet.isNodeLocal {
+				continue
+			}
+			for _, family := range familyOrder {
+				if len(localNet.pools[family]) == 0 {
+					continue
+				}
+				key := groupKey{networkID: nAttach.Network.ID, family: family}
+				groups[key] = append(groups[key], taskAttach{task: t, nAttach: nAttach})
+			}
+		}
+	}
+
+	// orderedGroupKeys walks groups one family at a time so every IPV4
+	// group is processed (and thus appends its address) before any IPV6
+	// group, regardless of which networkID a given group belongs to. See
+	// its doc comment for why ranging groups directly isn't safe here.
+	for _, key := range orderedGroupKeys(groups) {
+		group := groups[key]
+		localNet := na.getNetwork(key.networkID)
+
+		ipam, _, _, err := na.resolveIPAM(localNet.nw)
+		if err != nil {
+			for _, ta := range group {
+				if _, ok := taskErr[ta.task.ID]; !ok {
+					taskErr[ta.task.ID] = errors.Wrap(err, "failed to resolve IPAM while allocating")
+				}
+			}
+			continue
+		}
+
+		var opts map[string]string
+		if localNet.nw.IPAM != nil && localNet.nw.IPAM.Driver != nil {
+			opts = setIPAMSerialAlloc(localNet.nw.IPAM.Driver.Options)
+		}
+
+		pending := group
+		if br, ok := ipam.(batchAddressRequester); ok {
+			for poolID := range localNet.pools[key.family] {
+				ips, err := br.BatchRequestAddress(poolID, len(group), opts)
+				if err != nil {
+					break
+				}
+				n := len(ips)
+				if n > len(group) {
+					n = len(group)
+				}
+				for i := 0; i < n; i++ {
+					ipStr := ips[i].String()
+					localNet.endpoints[ipStr] = poolID
+					ta := group[i]
+					ta.nAttach.Addresses = append(ta.nAttach.Addresses, ipStr)
+					touched[ta.task.ID] = append(touched[ta.task.ID], ta.nAttach)
+				}
+				pending = group[n:]
+				break
+			}
+		}
+
+		for _, ta := range pending {
+			if _, ok := taskErr[ta.task.ID]; ok {
+				continue
+			}
+			ipStr, err := na.requestFamilyAddress(ipam, localNet, key.family, nil, opts)
+			if err != nil {
+				taskErr[ta.task.ID] = errors.Wrapf(err, "failed to allocate network IP for task %s network %s", ta.task.ID, key.networkID)
+				continue
+			}
+			ta.nAttach.Addresses = append(ta.nAttach.Addresses, ipStr)
+			touched[ta.task.ID] = append(touched[ta.task.ID], ta.nAttach)
+		}
+	}
+
+	for _, t := range tasks {
+		err, hasErr := taskErr[t.ID]
+		if !hasErr {
+			na.tasks[t.ID] = struct{}{}
+			allocated = append(allocated, t)
+			continue
+		}
+		if rbErr := na.releaseEndpoints(touched[t.ID]); rbErr != nil {
+			log.G(context.TODO()).WithError(rbErr).Errorf("Failed to release IP addresses while rolling back batch allocation for task %s", t.ID)
+		}
+		fail(t, err)
+	}
+
+	return allocated, failed
+}
+
+// DeallocateTask releases all the endpoint resources for all the
+// networks that a task is attached to.
+func (na *cnmNetAllocator) DeallocateTask(t *api.Task) error {
+	delete(na.tasks, t.ID)
+	return na.releaseEndpoints(t.Networks)
+}
+
+func (na *cnmNetAllocator) releaseEndpoints(networks []*api.NetworkAttachment) error {
+	for _, nAttach := range networks {
+		localNet := na.getNetwork(nAttach.Network.ID)
+		if localNet == nil {
+			return fmt.Errorf("could not find network allocator state for network %s", nAttach.Network.ID)
+		}
+
+		if localNet.isNodeLocal {
+			continue
+		}
+
+		ipam, _, _, err := na.resolveIPAM(nAttach.Network)
+		if err != nil {
+			return errors.Wrap(err, "failed to resolve IPAM while releasing")
+		}
+
+		// Do not fail and bail out if we fail to release IP
+		// address here. Keep going and try releasing as many
+		// addresses as possible.
+		for _, addr := range nAttach.Addresses {
+			// Retrieve the poolID and immediately nuke
+			// out the mapping.
+			poolID := localNet.endpoints[addr]
+			delete(localNet.endpoints, addr)
+
+			ip, _, err := net.ParseCIDR(addr)
+			if err != nil {
+				log.G(context.TODO()).Errorf("Could not parse IP address %s while releasing", addr)
+				continue
+			}
+
+			if err := ipam.ReleaseAddress(poolID, ip); err != nil {
+				log.G(context.TODO()).WithError(err).Errorf("IPAM failure while releasing IP address %s", addr)
+			}
+		}
+
+		// Clear out the address list when we are done with
+		// this network.
+		nAttach.Addresses = nil
+	}
+
+	return nil
+}
+
+// allocate virtual IP for a single endpoint attachment of the service.
+func (na *cnmNetAllocator) allocateVIP(vip *api.Endpoint_VirtualIP) error {
+	var opts map[string]string
+	localNet := na.getNetwork(vip.NetworkID)
+	if localNet == nil {
+		return errors.New("networkallocator: could not find local network state")
+	}
+
+	if localNet.isNodeLocal {
+		return nil
+	}
+
+	// If this IP is already allocated in memory we don't need to
+	// do anything.
+	if _, ok := localNet.endpoints[vip.Addr]; ok {
+		return nil
+	}
+
+	ipam, _, _, err := na.resolveIPAM(localNet.nw)
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve IPAM while allocating")
+	}
+
+	var addr net.IP
+	if vip.Addr != "" {
+		var err error
+
+		addr, _, err = net.ParseCIDR(vip.Addr)
+		if err != nil {
+			return err
+		}
+	}
+	if localNet.nw.IPAM != nil && localNet.nw.IPAM.Driver != nil {
+		// set ipam allocation method to serial
+		opts = setIPAMSerialAlloc(localNet.nw.IPAM.Driver.Options)
+	}
+
+	// api.Endpoint_VirtualIP only carries a single address, so a VIP is
+	// still allocated from a single family even on a dual-stack network;
+	// we prefer v4 when both are present, same as a task's first address.
+	for _, family := range familyOrder {
+		for _, poolID := range localNet.pools[family] {
+			ip, _, err := ipam.RequestAddress(poolID, addr, opts)
+			if err != nil && err != ipamapi.ErrNoAvailableIPs && err != ipamapi.ErrIPOutOfRange {
+				return errors.Wrap(err, "could not allocate VIP from IPAM")
+			}
+
+			// If we got an address then we are done.
+			if err == nil {
+				ipStr := ip.String()
+				localNet.endpoints[ipStr] = poolID
+				vip.Addr = ipStr
+				return nil
+			}
+		}
+	}
+
+	return errors.New("could not find an available IP while allocating VIP")
+}
+
+func (na *cnmNetAllocator) deallocateVIP(vip *api.Endpoint_VirtualIP) error {
+	localNet := na.getNetwork(vip.NetworkID)
+	if localNet == nil {
+		return errors.New("networkallocator: could not find local network state")
+	}
+	if localNet.isNodeLocal {
+		return nil
+	}
+	ipam, _, _, err := na.resolveIPAM(localNet.nw)
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve IPAM while allocating")
+	}
+
+	// Retrieve the poolID and immediately nuke
+	// out the mapping.
+	poolID := localNet.endpoints[vip.Addr]
+	delete(localNet.endpoints, vip.Addr)
+
+	ip, _, err := net.ParseCIDR(vip.Addr)
+	if err != nil {
+		log.G(context.TODO()).Errorf("Could not parse VIP address %s while releasing", vip.Addr)
+		return err
+	}
+
+	if err := ipam.ReleaseAddress(poolID, ip); err != nil {
+		log.G(context.TODO()).WithError(err).Errorf("IPAM failure while releasing VIP address %s", vip.Addr)
+		return err
+	}
+
+	return nil
+}
+
+// allocate the IP addresses for a single network attachment of the task.
+// On a dual-stack network this requests one address from each configured
+// family rather than stopping after the first success, so the attachment
+// ends up with both a v4 and a v6 address.
+func (na *cnmNetAllocator) allocateNetworkIPs(nAttach *api.NetworkAttachment) error {
+	var opts map[string]string
+
+	ipam, _, _, err := na.resolveIPAM(nAttach.Network)
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve IPAM while allocating")
+	}
+
+	localNet := na.getNetwork(nAttach.Network.ID)
+	if localNet == nil {
+		return fmt.Errorf("could not find network allocator state for network %s", nAttach.Network.ID)
+	}
+
+	// Set the ipam options if the network has an ipam driver.
+	if localNet.nw.IPAM != nil && localNet.nw.IPAM.Driver != nil {
+		// set ipam allocation method to serial
+		opts = setIPAMSerialAlloc(localNet.nw.IPAM.Driver.Options)
+	}
+
+	// If addresses are already present (e.g. while restoring from the
+	// store) re-request that specific address from the pool matching its
+	// family. Otherwise request one fresh address per configured family.
+	if len(nAttach.Addresses) > 0 {
+		addresses := make([]string, len(nAttach.Addresses))
+		for i, rawAddr := range nAttach.Addresses {
+			addr, err := parseAllocAddr(rawAddr)
+			if err != nil {
+				return err
+			}
+			ipStr, err := na.requestFamilyAddress(ipam, localNet, addressFamily(addr), addr, opts)
+			if err != nil {
+				return err
+			}
+			addresses[i] = ipStr
+		}
+		nAttach.Addresses = addresses
+		return nil
+	}
+
+	var addresses []string
+	for _, family := range familyOrder {
+		if len(localNet.pools[family]) == 0 {
+			continue
+		}
+		ipStr, err := na.requestFamilyAddress(ipam, localNet, family, nil, opts)
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, ipStr)
+	}
+
+	if len(addresses) == 0 {
+		return errors.New("could not find an available IP")
+	}
+
+	nAttach.Addresses = addresses
+	return nil
+}
+
+// requestFamilyAddress requests addr (or any free address if addr is nil)
+// from the pools of the given family, recording the winning poolID in
+// localNet.endpoints so it can be released symmetrically later.
+func (na *cnmNetAllocator) requestFamilyAddress(ipam ipamapi.Ipam, localNet *network, family api.IPAMConfig_Family, addr net.IP, opts map[string]string) (string, error) {
+	for _, poolID := range localNet.pools[family] {
+		ip, _, err := ipam.RequestAddress(poolID, addr, opts)
+		if err != nil && err != ipamapi.ErrNoAvailableIPs && err != ipamapi.ErrIPOutOfRange {
+			return "", errors.Wrap(err, "could not allocate IP from IPAM")
+		}
+
+		// If we got an address then we are done.
+		if err == nil {
+			ipStr := ip.String()
+			localNet.endpoints[ipStr] = poolID
+			return ipStr, nil
+		}
+	}
+
+	return "", errors.New("could not find an available IP")
+}
+
+// parseAllocAddr parses an address as stored in api.NetworkAttachment.Addresses,
+// which may be in CIDR form or a bare IP.
+func parseAllocAddr(rawAddr string) (net.IP, error) {
+	if rawAddr == "" {
+		return nil, nil
+	}
+	addr, _, err := net.ParseCIDR(rawAddr)
+	if err == nil {
+		return addr, nil
+	}
+	if addr := net.ParseIP(rawAddr); addr != nil {
+		return addr, nil
+	}
+	return nil, errors.Wrapf(err, "could not parse address string %s", rawAddr)
+}
+
+// addressFamily returns the api.IPAMConfig_Family of addr, defaulting to
+// IPv4 when addr is nil (fresh allocation with no hint available).
+func addressFamily(addr net.IP) api.IPAMConfig_Family {
+	if addr != nil && addr.To4() == nil {
+		return api.IPAMConfig_IPV6
+	}
+	return api.IPAMConfig_IPV4
+}
+
+func (na *cnmNetAllocator) freeDriverState(n *api.Network) error {
+	d, err := na.resolveDriver(n)
+	if err != nil {
+		return err
+	}
+
+	return d.driver.NetworkFree(n.ID)
+}
+
+func (na *cnmNetAllocator) allocateDriverState(n *api.Network) error {
+	d, err := na.resolveDriver(n)
+	if err != nil {
+		return err
+	}
+
+	options := make(map[string]string)
+	// reconcile the driver specific options from the network spec
+	// and from the operational state retrieved from the store
+	if n.Spec.DriverConfig != nil {
+		for k, v := range n.Spec.DriverConfig.Options {
+			options[k] = v
+		}
+	}
+	if n.DriverState != nil {
+		for k, v := range n.DriverState.Options {
+			options[k] = v
+		}
+	}
+
+	// Construct IPAM data for driver consumption, split by family so
+	// dual-stack networks hand both a v4 and v6 pool to the driver.
+	ipv4Data := make([]driverapi.IPAMData, 0, len(n.IPAM.Configs))
+	ipv6Data := make([]driverapi.IPAMData, 0, len(n.IPAM.Configs))
+	for _, ic := range n.IPAM.Configs {
+		_, subnet, err := net.ParseCIDR(ic.Subnet)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing subnet %s while allocating driver state", ic.Subnet)
+		}
+
+		gwIP := net.ParseIP(ic.Gateway)
+		gwNet := &net.IPNet{
+			IP:   gwIP,
+			Mask: subnet.Mask,
+		}
+
+		data := driverapi.IPAMData{
+			Pool:    subnet,
+			Gateway: gwNet,
+		}
+
+		if ic.Family == api.IPAMConfig_IPV6 {
+			ipv6Data = append(ipv6Data, data)
+		} else {
+			ipv4Data = append(ipv4Data, data)
+		}
+	}
+
+	ds, err := d.driver.NetworkAllocate(n.ID, options, ipv4Data, ipv6Data)
+	if err != nil {
+		return err
+	}
+
+	// Update network object with the obtained driver state.
+	n.DriverState = &api.Driver{
+		Name:    d.name,
+		Options: ds,
+	}
+
+	return nil
+}
+
+// Resolve network driver
+func (na *cnmNetAllocator) resolveDriver(n *api.Network) (*networkDriver, error) {
+	dName := DefaultDriver
+	if n.Spec.DriverConfig != nil && n.Spec.DriverConfig.Name != "" {
+		dName = n.Spec.DriverConfig.Name
+	}
+
+	d, drvcap := na.drvRegistry.Driver(dName)
+	if d == nil {
+		var err error
+		err = na.loadDriver(dName)
+		if err != nil {
+			return nil, err
+		}
+
+		d, drvcap = na.drvRegistry.Driver(dName)
+		if d == nil {
+			return nil, fmt.Errorf("could not resolve network driver %s", dName)
+		}
+	}
+
+	return &networkDriver{driver: d, capability: drvcap, name: dName}, nil
+}
+
+func (na *cnmNetAllocator) loadDriver(name string) error {
+	pg := na.drvRegistry.GetPluginGetter()
+	if pg == nil {
+		return errors.New("plugin store is uninitialized")
+	}
+	_, err := pg.Get(name, driverapi.NetworkPluginEndpointType, plugingetter.Lookup)
+	return err
+}
+
+// Resolve the IPAM driver
+func (na *cnmNetAllocator) resolveIPAM(n *api.Network) (ipamapi.Ipam, string, map[string]string, error) {
+	dName := ipamapi.DefaultIPAM
+	if n.Spec.IPAM != nil && n.Spec.IPAM.Driver != nil && n.Spec.IPAM.Driver.Name != "" {
+		dName = n.Spec.IPAM.Driver.Name
+	}
+
+	var dOptions map[string]string
+	if n.Spec.IPAM != nil && n.Spec.IPAM.Driver != nil && len(n.Spec.IPAM.Driver.Options) != 0 {
+		dOptions = n.Spec.IPAM.Driver.Options
+	}
+
+	ipam, _ := na.drvRegistry.IPAM(dName)
+	if ipam == nil {
+		return nil, "", nil, fmt.Errorf("could not resolve IPAM driver %s", dName)
+	}
+
+	return ipam, dName, dOptions, nil
+}
+
+func (na *cnmNetAllocator) freePools(n *api.Network, pools map[api.IPAMConfig_Family]map[string]string) error {
+	ipam, _, _, err := na.resolveIPAM(n)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve IPAM while freeing pools for network %s", n.ID)
+	}
+
+	releasePools(ipam, n.IPAM.Configs, pools)
+	return nil
+}
+
+func releasePools(ipam ipamapi.Ipam, icList []*api.IPAMConfig, pools map[api.IPAMConfig_Family]map[string]string) {
+	for _, ic := range icList {
+		if err := ipam.ReleaseAddress(pools[ic.Family][ic.Subnet], net.ParseIP(ic.Gateway)); err != nil {
+			log.G(context.TODO()).WithError(err).Errorf("Failed to release address %s", ic.Subnet)
+		}
+	}
+
+	for _, familyPools := range pools {
+		for k, p := range familyPools {
+			if err := ipam.ReleasePool(p); err != nil {
+				log.G(context.TODO()).WithError(err).Errorf("Failed to release pool %s", k)
+			}
+		}
+	}
+}
+
+// validateAddressSpace performs a syntactic sanity check on a
+// user-supplied IPAMConfig.AddressSpace. libnetwork's built-in/null IPAM
+// drivers create an address space bucket lazily the first time it's
+// requested rather than keeping a registry of valid names, so there is
+// nothing to look a custom space up against beyond the driver's own
+// reported defaults: any non-default value is accepted as long as it's a
+// plausible bucket name, not a path or empty string.
+func validateAddressSpace(as, localAS, globalAS string) error {
+	if as == localAS || as == globalAS {
+		return nil
+	}
+	if strings.TrimSpace(as) == "" {
+		return fmt.Errorf("address space must not be empty")
+	}
+	if strings.ContainsAny(as, "/\\") {
+		return fmt.Errorf("invalid address space %q", as)
+	}
+	return nil
+}
+
+// validateIPAMConfigs runs validateAddressSpace over every config up
+// front, before allocatePools requests a single pool, so a network with
+// one bad AddressSpace among several configs fails immediately instead
+// of after already allocating pools for the configs ahead of it.
+func validateIPAMConfigs(ipamConfigs []*api.IPAMConfig, localAS, globalAS string) error {
+	for _, ic := range ipamConfigs {
+		if ic.AddressSpace == "" {
+			continue
+		}
+		if err := validateAddressSpace(ic.AddressSpace, localAS, globalAS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (na *cnmNetAllocator) allocatePools(n *api.Network) (map[api.IPAMConfig_Family]map[string]string, error) {
+	ipam, dName, dOptions, err := na.resolveIPAM(n)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retrieve the driver's default (local and global) address space
+	// names; a per-config AddressSpace, if set, overrides these so an
+	// operator can isolate a network's pool into its own IP universe
+	// (e.g. a per-tenant space) instead of the driver's shared default.
+	localAS, globalAS, err := na.drvRegistry.IPAMDefaultAddressSpaces(dName)
+	if err != nil {
+		return nil, err
+	}
+	asName := globalAS
+
+	pools := make(map[api.IPAMConfig_Family]map[string]string)
+
+	var ipamConfigs []*api.IPAMConfig
+
+	// If there is non-nil IPAM state always prefer those subnet
+	// configs over Spec configs.
+	if n.IPAM != nil {
+		ipamConfigs = n.IPAM.Configs
+	} else if n.Spec.IPAM != nil {
+		ipamConfigs = make([]*api.IPAMConfig, len(n.Spec.IPAM.Configs))
+		copy(ipamConfigs, n.Spec.IPAM.Configs)
+	}
+
+	// Append an empty slot for subnet allocation if there are no
+	// IPAM configs from either spec or state.
+	if len(ipamConfigs) == 0 {
+		ipamConfigs = append(ipamConfigs, &api.IPAMConfig{Family: api.IPAMConfig_IPV4})
+	}
+
+	// A user-supplied subnet's family may not have been set explicitly;
+	// derive it from the CIDR so a v6 subnet doesn't get mistaken for the
+	// default v4 family below.
+	var haveIPv6 bool
+	for _, ic := range ipamConfigs {
+		if ic.Subnet != "" {
+			if _, subnet, err := net.ParseCIDR(ic.Subnet); err == nil && subnet.IP.To4() == nil {
+				ic.Family = api.IPAMConfig_IPV6
+			}
+		}
+		if ic.Family == api.IPAMConfig_IPV6 {
+			haveIPv6 = true
+		}
+	}
+
+	// EnableIPv6 asks for a v6 pool alongside whatever v4 (and possibly
+	// user-supplied v6) configs are already present.
+	if n.Spec.EnableIPv6 && !haveIPv6 {
+		ipamConfigs = append(ipamConfigs, &api.IPAMConfig{Family: api.IPAMConfig_IPV6})
+	}
+
+	// Validate every config's AddressSpace before requesting any pool, so
+	// a single bad value fails the network's allocation up front instead
+	// of after pools for the configs ahead of it have already been
+	// claimed from the driver.
+	if err := validateIPAMConfigs(ipamConfigs, localAS, globalAS); err != nil {
+		return nil, errors.Wrapf(err, "network %s", n.ID)
+	}
+
+	// Update the runtime IPAM configurations with initial state
+	n.IPAM = &api.IPAMOptions{
+		Driver:  &api.Driver{Name: dName, Options: dOptions},
+		Configs: ipamConfigs,
+	}
+
+	for i, ic := range ipamConfigs {
+		as := asName
+		if ic.AddressSpace != "" {
+			as = ic.AddressSpace
+		}
+
+		poolID, poolIP, meta, err := ipam.RequestPool(as, ic.Subnet, ic.Range, dOptions, ic.Family == api.IPAMConfig_IPV6)
+		if err != nil {
+			// Rollback by releasing all the resources allocated so far.
+			releasePools(ipam, ipamConfigs[:i], pools)
+			return nil, err
+		}
+		// Persist the resolved address space so Restore and Deallocate
+		// release from the same space this pool was requested from.
+		ic.AddressSpace = as
+		if pools[ic.Family] == nil {
+			pools[ic.Family] = make(map[string]string)
+		}
+		pools[ic.Family][poolIP.String()] = poolID
+
+		// The IPAM contract allows the IPAM driver to autonomously
+		// provide a network gateway in response to the pool request.
+		// But if the network spec contains a gateway, we will allocate
+		// it irrespective of whether the ipam driver returned one already.
+		// If none of the above is true, we need to allocate one now, and
+		// let the driver know this request is for the network gateway.
+		var (
+			gwIP *net.IPNet
+			ip   net.IP
+		)
+		if gws, ok := meta[netlabel.Gateway]; ok {
+			if ip, gwIP, err = net.ParseCIDR(gws); err != nil {
+				return nil, fmt.Errorf("failed to parse gateway address (%v) returned by ipam driver: %v", gws, err)
+			}
+			gwIP.IP = ip
+		}
+		if dOptions == nil {
+			dOptions = make(map[string]string)
+		}
+		dOptions[ipamapi.RequestAddressType] = netlabel.Gateway
+		// set ipam allocation method to serial
+		dOptions = setIPAMSerialAlloc(dOptions)
+		defer delete(dOptions, ipamapi.RequestAddressType)
+
+		if ic.Gateway != "" || gwIP == nil {
+			gwIP, _, err = ipam.RequestAddress(poolID, net.ParseIP(ic.Gateway), dOptions)
+			if err != nil {
+				// Rollback by releasing all the resources allocated so far.
+				releasePools(ipam, ipamConfigs[:i], pools)
+				return nil, err
+			}
+		}
+
+		if ic.Subnet == "" {
+			ic.Subnet = poolIP.String()
+		}
+
+		if ic.Gateway == "" {
+			ic.Gateway = gwIP.IP.String()
+		}
+
+	}
+
+	return pools, nil
+}
+
+func initializeDrivers(reg *drvregistry.DrvRegistry) error {
+	for _, i := range initializers {
+		if err := reg.AddDriver(i.ntype, i.fn, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serviceNetworks(s *api.Service) []*api.NetworkAttachmentConfig {
+	// Always prefer NetworkAttachmentConfig in the TaskSpec
+	if len(s.Spec.Task.Networks) == 0 && len(s.Spec.Networks) != 0 {
+		return s.Spec.Networks
+	}
+	return s.Spec.Task.Networks
+}
+
+// IsVIPOnIngressNetwork check if the vip is in ingress network
+func (na *cnmNetAllocator) IsVIPOnIngressNetwork(vip *api.Endpoint_VirtualIP) bool {
+	if vip == nil {
+		return false
+	}
+
+	localNet := na.getNetwork(vip.NetworkID)
+	if localNet != nil && localNet.nw != nil {
+		return networkallocator.IsIngressNetwork(localNet.nw)
+	}
+	return false
+}
+
+// IngressNetworks returns every allocated network with Spec.Ingress set
+// (or the legacy "ingress" network), so callers can select the subset
+// relevant to a given service via networkallocator.SelectIngressNetworks.
+func (na *cnmNetAllocator) IngressNetworks() []*api.Network {
+	var nets []*api.Network
+	for _, nw := range na.networks {
+		if nw.nw != nil && networkallocator.IsIngressNetwork(nw.nw) {
+			nets = append(nets, nw.nw)
+		}
+	}
+	return nets
+}
+
+// IsBuiltInDriver returns whether the passed driver is an internal network driver
+func IsBuiltInDriver(name string) bool {
+	n := strings.ToLower(name)
+	for _, d := range initializers {
+		if n == d.ntype {
+			return true
+		}
+	}
+	return false
+}
+
+// setIPAMSerialAlloc sets the ipam allocation method to serial
+func setIPAMSerialAlloc(opts map[string]string) map[string]string {
+	if opts == nil {
+		opts = make(map[string]string)
+	}
+	if _, ok := opts[ipamapi.AllocSerialPrefix]; !ok {
+		opts[ipamapi.AllocSerialPrefix] = "true"
+	}
+	return opts
+}
@@ -0,0 +1,39 @@
+package cnmallocator
+
+import (
+	"testing"
+
+	"github.com/docker/swarmkit/api"
+)
+
+func TestOrderedGroupKeysOrdersIPv4BeforeIPv6(t *testing.T) {
+	// Several networks, each contributing both an IPV4 and an IPV6 group,
+	// so a map with a random iteration order can't accidentally satisfy
+	// the ordering by coincidence.
+	groups := map[groupKey][]taskAttach{
+		{networkID: "net-a", family: api.IPAMConfig_IPV4}: {{task: &api.Task{ID: "a"}}},
+		{networkID: "net-a", family: api.IPAMConfig_IPV6}: {{task: &api.Task{ID: "a"}}},
+		{networkID: "net-b", family: api.IPAMConfig_IPV4}: {{task: &api.Task{ID: "b"}}},
+		{networkID: "net-b", family: api.IPAMConfig_IPV6}: {{task: &api.Task{ID: "b"}}},
+		{networkID: "net-c", family: api.IPAMConfig_IPV4}: {{task: &api.Task{ID: "c"}}},
+	}
+
+	for i := 0; i < 50; i++ {
+		keys := orderedGroupKeys(groups)
+		if len(keys) != len(groups) {
+			t.Fatalf("orderedGroupKeys returned %d keys, want %d", len(keys), len(groups))
+		}
+
+		sawIPv6 := false
+		for _, key := range keys {
+			switch key.family {
+			case api.IPAMConfig_IPV6:
+				sawIPv6 = true
+			case api.IPAMConfig_IPV4:
+				if sawIPv6 {
+					t.Fatalf("IPV4 key %+v returned after an IPV6 key in %+v", key, keys)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package cnmallocator
+
+import (
+	"github.com/docker/libnetwork/ipamutils"
+	"github.com/docker/swarmkit/manager/allocator/networkallocator"
+)
+
+// defaultSubnetSize is used to cut cfg.DefaultAddrPool into subnets when
+// cfg.SubnetSize isn't set, matching the engine's own default.
+const defaultSubnetSize = 24
+
+// configureDefaultAddressPools narrows the built-in IPAM driver's global
+// default address pools down to cfg's, so a cluster whose corporate
+// network collides with libnetwork's hard-coded 172.x ranges can steer
+// automatic subnet selection elsewhere -- the swarm-mode equivalent of
+// the engine's --default-address-pool flag.
+func configureDefaultAddressPools(cfg *networkallocator.Config) error {
+	size := int(cfg.SubnetSize)
+	if size == 0 {
+		size = defaultSubnetSize
+	}
+
+	pools := make([]*ipamutils.NetworkToSplit, 0, len(cfg.DefaultAddrPool))
+	for _, base := range cfg.DefaultAddrPool {
+		pools = append(pools, &ipamutils.NetworkToSplit{Base: base, Size: size})
+	}
+
+	return ipamutils.ConfigGlobalScopeDefaultNetworks(pools)
+}
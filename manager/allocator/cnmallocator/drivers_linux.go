@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package cnmallocator
+
+import (
+	"github.com/docker/libnetwork/drivers/bridge/brmanager"
+	"github.com/docker/libnetwork/drivers/host"
+	"github.com/docker/libnetwork/drivers/ipvlan/ivmanager"
+	"github.com/docker/libnetwork/drivers/macvlan/mvmanager"
+	"github.com/docker/libnetwork/drivers/overlay/ovmanager"
+	"github.com/docker/libnetwork/drivers/remote"
+	"github.com/docker/libnetwork/drvregistry"
+	builtinIpam "github.com/docker/libnetwork/ipams/builtin"
+	nullIpam "github.com/docker/libnetwork/ipams/null"
+	remoteIpam "github.com/docker/libnetwork/ipams/remote"
+)
+
+var initializers = []initializer{
+	{remote.Init, "remote"},
+	{ovmanager.Init, "overlay"},
+	{mvmanager.Init, "macvlan"},
+	{ivmanager.Init, "ipvlan"},
+	{brmanager.Init, "bridge"},
+	{host.Init, "host"},
+}
+
+// initIPAMDrivers registers the built-in default and null IPAM drivers,
+// plus the remote IPAM driver. The remote driver activates any engine
+// plugin discovered through r's plugin getter that advertises the IPAM
+// capability and routes RequestPool/RequestAddress/ReleaseAddress calls
+// over that plugin's RPC socket, which is how third-party IPAM drivers
+// (e.g. Calico, Infoblox) get wired into a cnmallocator without a
+// swarmkit rebuild.
+func initIPAMDrivers(r *drvregistry.DrvRegistry) error {
+	if err := builtinIpam.Init(r, nil, nil); err != nil {
+		return err
+	}
+	if err := nullIpam.Init(r, nil, nil); err != nil {
+		return err
+	}
+	return remoteIpam.Init(r, nil, nil)
+}
@@ -0,0 +1,151 @@
+package cnmallocator
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/pkg/plugingetter"
+	"github.com/docker/docker/pkg/plugins"
+	"github.com/docker/swarmkit/log"
+	"github.com/docker/swarmkit/node/plugin"
+	"golang.org/x/net/context"
+)
+
+// AdaptPluginGetter converts a moby pkg/plugingetter.PluginGetter into the
+// plugin.Getter that New expects, so that swarmd (or any other caller
+// wiring up a manager) does not need to import node/plugin just to satisfy
+// the interface.
+func AdaptPluginGetter(pg plugingetter.PluginGetter) plugin.Getter {
+	if pg == nil {
+		return nil
+	}
+	return &pluginGetterAdapter{pg: pg}
+}
+
+type pluginGetterAdapter struct {
+	pg plugingetter.PluginGetter
+}
+
+func (a *pluginGetterAdapter) Get(name, capability string, mode int) (plugin.CompatPlugin, error) {
+	p, err := a.pg.Get(name, capability, mode)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	return &compatPluginAdapter{p: p}, nil
+}
+
+func (a *pluginGetterAdapter) GetAllByCap(capability string) ([]plugin.CompatPlugin, error) {
+	plugins, err := a.pg.GetAllByCap(capability)
+	if err != nil {
+		return nil, err
+	}
+	return wrapCompatPlugins(plugins), nil
+}
+
+func (a *pluginGetterAdapter) GetAllManagedPluginsByCap(capability string) []plugin.CompatPlugin {
+	return wrapCompatPlugins(a.pg.GetAllManagedPluginsByCap(capability))
+}
+
+func wrapCompatPlugins(plugins []plugingetter.CompatPlugin) []plugin.CompatPlugin {
+	wrapped := make([]plugin.CompatPlugin, 0, len(plugins))
+	for _, p := range plugins {
+		wrapped = append(wrapped, &compatPluginAdapter{p: p})
+	}
+	return wrapped
+}
+
+type compatPluginAdapter struct {
+	p plugingetter.CompatPlugin
+}
+
+func (a *compatPluginAdapter) Name() string { return a.p.Name() }
+func (a *compatPluginAdapter) IsV1() bool   { return a.p.IsV1() }
+func (a *compatPluginAdapter) Client() plugin.Client {
+	return a.p.Client()
+}
+
+// newPluginGetterShim wraps a plugin.Getter back into the moby
+// plugingetter.PluginGetter shape that libnetwork's drvregistry expects,
+// so the rest of this package only ever has to deal with swarmkit's own
+// narrow interface. Dynamic plugin (un)registration notifications via
+// Handle are not supported through this path.
+func newPluginGetterShim(pg plugin.Getter) plugingetter.PluginGetter {
+	if pg == nil {
+		return nil
+	}
+	return &pluginGetterShim{pg: pg}
+}
+
+type pluginGetterShim struct {
+	pg plugin.Getter
+}
+
+func (s *pluginGetterShim) Get(name, capability string, mode int) (plugingetter.CompatPlugin, error) {
+	p, err := s.pg.Get(name, capability, mode)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	shim, err := newCompatPluginShim(p)
+	if err != nil {
+		return nil, err
+	}
+	return shim, nil
+}
+
+func (s *pluginGetterShim) GetAllByCap(capability string) ([]plugingetter.CompatPlugin, error) {
+	plugins, err := s.pg.GetAllByCap(capability)
+	if err != nil {
+		return nil, err
+	}
+	return wrapCompatPluginShims(plugins), nil
+}
+
+func (s *pluginGetterShim) GetAllManagedPluginsByCap(capability string) []plugingetter.CompatPlugin {
+	return wrapCompatPluginShims(s.pg.GetAllManagedPluginsByCap(capability))
+}
+
+func (s *pluginGetterShim) Handle(capability string, callback func(string, *plugins.Client)) {
+	// Remote drivers discovered through the narrow plugin.Getter boundary
+	// don't support hot (un)registration notifications.
+}
+
+// wrapCompatPluginShims wraps every plugin that can back a
+// plugingetter.CompatPlugin, skipping (and logging) any that can't
+// rather than letting one bad plugin.Getter implementation take down
+// the whole enumeration.
+func wrapCompatPluginShims(plugins []plugin.CompatPlugin) []plugingetter.CompatPlugin {
+	wrapped := make([]plugingetter.CompatPlugin, 0, len(plugins))
+	for _, p := range plugins {
+		shim, err := newCompatPluginShim(p)
+		if err != nil {
+			log.G(context.TODO()).WithError(err).Warn("skipping plugin incompatible with libnetwork driver activation")
+			continue
+		}
+		wrapped = append(wrapped, shim)
+	}
+	return wrapped
+}
+
+type compatPluginShim struct {
+	name   string
+	isV1   bool
+	client *plugins.Client
+}
+
+// newCompatPluginShim wraps p as a plugingetter.CompatPlugin, resolving
+// and checking p.Client() once up front. plugingetter.CompatPlugin's
+// Client method has no way to report an error, so a p whose Client()
+// isn't backed by a concrete *plugins.Client -- the only type
+// libnetwork's driver activation code knows how to call -- is rejected
+// here, at the plugin.Getter boundary, instead of panicking later deep
+// inside drvregistry when Client() is finally called.
+func newCompatPluginShim(p plugin.CompatPlugin) (*compatPluginShim, error) {
+	c, ok := p.Client().(*plugins.Client)
+	if !ok {
+		return nil, fmt.Errorf("cnmallocator: plugin %s did not return a *plugins.Client, cannot be used as a libnetwork remote driver", p.Name())
+	}
+	return &compatPluginShim{name: p.Name(), isV1: p.IsV1(), client: c}, nil
+}
+
+func (s *compatPluginShim) Name() string            { return s.name }
+func (s *compatPluginShim) IsV1() bool              { return s.isV1 }
+func (s *compatPluginShim) Client() *plugins.Client { return s.client }
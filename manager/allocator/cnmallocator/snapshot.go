@@ -0,0 +1,101 @@
+package cnmallocator
+
+import (
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/manager/allocator/networkallocator"
+)
+
+func familyLabel(family api.IPAMConfig_Family) string {
+	if family == api.IPAMConfig_IPV6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func familyFromLabel(label string) api.IPAMConfig_Family {
+	if label == "IPv6" {
+		return api.IPAMConfig_IPV6
+	}
+	return api.IPAMConfig_IPV4
+}
+
+// Snapshot returns a serializable copy of the allocator's pools,
+// endpoints and "allocated" marker sets.
+func (na *cnmNetAllocator) Snapshot() (*networkallocator.Snapshot, error) {
+	snap := networkallocator.NewSnapshot()
+
+	for id, nw := range na.networks {
+		ns := networkallocator.NetworkSnapshot{
+			IsNodeLocal: nw.isNodeLocal,
+			Pools:       make(map[string]map[string]string, len(nw.pools)),
+			Endpoints:   make(map[string]string, len(nw.endpoints)),
+		}
+		for family, pools := range nw.pools {
+			familyPools := make(map[string]string, len(pools))
+			for subnet, poolID := range pools {
+				familyPools[subnet] = poolID
+			}
+			ns.Pools[familyLabel(family)] = familyPools
+		}
+		for addr, poolID := range nw.endpoints {
+			ns.Endpoints[addr] = poolID
+		}
+		snap.Networks[id] = ns
+	}
+
+	for id := range na.services {
+		snap.Services[id] = struct{}{}
+	}
+	for id := range na.tasks {
+		snap.Tasks[id] = struct{}{}
+	}
+	for id := range na.nodes {
+		snap.Nodes[id] = struct{}{}
+	}
+
+	return snap, nil
+}
+
+// Restore rehydrates na's in-memory state from a previously taken
+// Snapshot. It does not contact the IPAM driver: network objects are
+// still expected to flow through Allocate as normal so that
+// na.networks[id].nw gets populated, but doing so for a network whose ID
+// already appears in the restored snapshot reuses the persisted pools
+// and endpoints instead of calling RequestPool/RequestAddress again.
+func (na *cnmNetAllocator) Restore(snap *networkallocator.Snapshot) error {
+	if snap == nil {
+		return nil
+	}
+
+	for id, ns := range snap.Networks {
+		nw := &network{
+			pools:       make(map[api.IPAMConfig_Family]map[string]string, len(ns.Pools)),
+			endpoints:   make(map[string]string, len(ns.Endpoints)),
+			isNodeLocal: ns.IsNodeLocal,
+		}
+		for label, pools := range ns.Pools {
+			family := familyFromLabel(label)
+			familyPools := make(map[string]string, len(pools))
+			for subnet, poolID := range pools {
+				familyPools[subnet] = poolID
+			}
+			nw.pools[family] = familyPools
+		}
+		for addr, poolID := range ns.Endpoints {
+			nw.endpoints[addr] = poolID
+		}
+		na.networks[id] = nw
+	}
+
+	for id := range snap.Services {
+		na.services[id] = struct{}{}
+	}
+	for id := range snap.Tasks {
+		na.tasks[id] = struct{}{}
+	}
+	for id := range snap.Nodes {
+		na.nodes[id] = struct{}{}
+	}
+
+	return nil
+}
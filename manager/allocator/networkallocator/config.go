@@ -0,0 +1,18 @@
+package networkallocator
+
+// Config carries cluster-wide defaults a NetworkAllocator backend should
+// apply when a network spec doesn't pin its own IPAM configuration, so
+// operators aren't stuck with whatever ranges the backend happens to
+// compile in.
+type Config struct {
+	// DefaultAddrPool overrides the default IPAM driver's built-in
+	// default address pool (e.g. libnetwork's hard-coded 172.x ranges)
+	// with the given list of CIDRs, mirroring the engine's
+	// --default-address-pool flag.
+	DefaultAddrPool []string
+
+	// SubnetSize is the prefix length subnets are cut to out of
+	// DefaultAddrPool when a network doesn't request one explicitly.
+	// Ignored if DefaultAddrPool is empty.
+	SubnetSize uint32
+}
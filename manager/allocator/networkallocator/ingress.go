@@ -0,0 +1,59 @@
+package networkallocator
+
+import "github.com/docker/swarmkit/api"
+
+// IngressNetworkLabel, when set on a service's annotations, names the
+// ingress network (by its Spec.Annotations.Name) that the service's
+// ingress-mode published ports should be routed through. It lets
+// operators run more than one ingress network in a cluster -- e.g. one
+// per tenant or edge -- instead of every ingress-mode service
+// collapsing onto whichever single network happens to have Ingress set.
+//
+// A PortConfig-level field would let this be expressed per-port, but
+// swarmkit's generated api.PortConfig has no room for it without a wire
+// format change, so for now the selection is made once per service.
+const IngressNetworkLabel = "com.docker.swarm.ingress-network"
+
+// SelectIngressNetworks narrows allIngress (as returned by a
+// NetworkAllocator's IngressNetworks method) down to the single network
+// relevant to s: the one named by s's IngressNetworkLabel annotation, if
+// set and found, or otherwise defaultIngressNetwork's pick among
+// allIngress. A service never fans out to every known ingress network --
+// the whole point of the label is to let an operator run more than one
+// without every unlabeled service's ingress traffic landing on all of
+// them at once.
+func SelectIngressNetworks(allIngress []*api.Network, s *api.Service) []*api.Network {
+	if s == nil || len(allIngress) == 0 {
+		return allIngress
+	}
+
+	if name := s.Spec.Annotations.Labels[IngressNetworkLabel]; name != "" {
+		for _, nw := range allIngress {
+			if nw.Spec.Annotations.Name == name {
+				return []*api.Network{nw}
+			}
+		}
+		// Named network not found (yet, or misconfigured): fall through
+		// to the default below rather than silently dropping ingress
+		// routing.
+	}
+
+	return []*api.Network{defaultIngressNetwork(allIngress)}
+}
+
+// defaultIngressNetwork picks the one ingress network an unlabeled
+// service's VIP is allocated on when the cluster has more than one: the
+// first-created network, identified by the lowest raft commit index in
+// its Meta.Version. This keeps the historical single-ingress-network
+// behavior stable for every pre-existing, unlabeled service as of the
+// moment a second ingress network is added, rather than having their
+// VIPs silently fan out to the new network too.
+func defaultIngressNetwork(allIngress []*api.Network) *api.Network {
+	best := allIngress[0]
+	for _, nw := range allIngress[1:] {
+		if nw.Meta.Version.Index < best.Meta.Version.Index {
+			best = nw
+		}
+	}
+	return best
+}
@@ -0,0 +1,47 @@
+package networkallocator
+
+// Snapshot is a serializable copy of a NetworkAllocator's in-memory
+// bookkeeping. It lets a manager persist allocator state (to the raft
+// store, via manager/allocator) and have a newly elected leader rehydrate
+// it in Restore instead of re-driving Allocate/ServiceAllocate/AllocateTask
+// against every object in the cluster, which is both an O(N) burst of work
+// at leadership change and, for IPAM drivers with opaque pool IDs, a risk
+// of double-allocating addresses that were already handed out.
+type Snapshot struct {
+	// Networks holds allocator state keyed by network ID.
+	Networks map[string]NetworkSnapshot
+
+	// Services/Tasks/Nodes record which objects the allocator considers
+	// fully allocated, mirroring the in-memory "allocated" marker sets.
+	Services map[string]struct{}
+	Tasks    map[string]struct{}
+	Nodes    map[string]struct{}
+}
+
+// NetworkSnapshot is the persisted state for a single network.
+type NetworkSnapshot struct {
+	// IsNodeLocal mirrors network.isNodeLocal: true for networks whose
+	// resources are allocated per-node rather than by the manager.
+	IsNodeLocal bool
+
+	// Pools holds the backend's IPAM pool IDs, keyed first by a
+	// backend-defined family label (e.g. "IPv4"/"IPv6" for cnmallocator)
+	// and then by pool subnet, matching the shape cnmallocator keeps in
+	// memory. Backends that don't track pools (e.g. cniallocator) leave
+	// this empty.
+	Pools map[string]map[string]string
+
+	// Endpoints maps an allocated address to the pool ID (or other
+	// backend-specific handle) it was allocated from.
+	Endpoints map[string]string
+}
+
+// NewSnapshot returns an empty, ready to populate Snapshot.
+func NewSnapshot() *Snapshot {
+	return &Snapshot{
+		Networks: make(map[string]NetworkSnapshot),
+		Services: make(map[string]struct{}),
+		Tasks:    make(map[string]struct{}),
+		Nodes:    make(map[string]struct{}),
+	}
+}
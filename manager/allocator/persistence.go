@@ -0,0 +1,99 @@
+// Package allocator ties together the network, node and other resource
+// allocators used by the manager. This file provides the glue between
+// networkallocator.NetworkAllocator's Snapshot/Restore pair and the raft
+// store: PersistNetworkAllocatorState and RestoreNetworkAllocatorState
+// are the primitives a leader's allocator event loop needs to rehydrate
+// allocator state in O(1) per object instead of re-driving
+// Allocate/ServiceAllocate/AllocateTask against every network, service,
+// task and node in the cluster on every leadership change.
+//
+// Wiring RestoreNetworkAllocatorState into that event loop's OnInit pass
+// is a follow-up: the loop itself lives in this package's network.go,
+// which predates this series and isn't part of it.
+package allocator
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/docker/swarmkit/manager/allocator/networkallocator"
+	"github.com/pkg/errors"
+)
+
+// StateKey is the well-known key under which the encoded
+// networkallocator.Snapshot is stored by the raft-backed store.
+const StateKey = "network_allocator_state"
+
+// StatePersister is implemented by the raft store's allocator state
+// bucket. SaveState is expected to be called inside the same
+// store.Batch/Tx as the object mutations it snapshots, and State is
+// expected to be read inside the transaction the allocator's OnInit
+// restore runs in.
+type StatePersister interface {
+	SaveState(key string, data []byte) error
+	State(key string) ([]byte, error)
+}
+
+// EncodeSnapshot serializes a networkallocator.Snapshot for storage.
+func EncodeSnapshot(snap *networkallocator.Snapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snap); err != nil {
+		return nil, errors.Wrap(err, "failed to encode network allocator snapshot")
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeSnapshot deserializes a networkallocator.Snapshot previously
+// produced by EncodeSnapshot. It returns a nil snapshot, nil error if
+// data is empty, so callers can treat "never persisted" the same as
+// "restored an empty snapshot".
+func DecodeSnapshot(data []byte) (*networkallocator.Snapshot, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	snap := &networkallocator.Snapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(snap); err != nil {
+		return nil, errors.Wrap(err, "failed to decode network allocator snapshot")
+	}
+	return snap, nil
+}
+
+// PersistNetworkAllocatorState snapshots na and writes it to p under
+// StateKey. Callers are expected to invoke this periodically (e.g. once
+// per allocator event loop tick) rather than on every single allocation,
+// since a snapshot captures the full allocator state.
+func PersistNetworkAllocatorState(p StatePersister, na networkallocator.NetworkAllocator) error {
+	snap, err := na.Snapshot()
+	if err != nil {
+		return errors.Wrap(err, "failed to snapshot network allocator state")
+	}
+	data, err := EncodeSnapshot(snap)
+	if err != nil {
+		return err
+	}
+	return p.SaveState(StateKey, data)
+}
+
+// RestoreNetworkAllocatorState reads a previously persisted snapshot from
+// p and applies it to na via na.Restore. It is a no-op if nothing has
+// ever been persisted under StateKey.
+//
+// It is meant to be called once, before the allocator's OnInit pass
+// walks the store's existing networks/services/tasks/nodes, so that pass
+// can skip objects Restore already accounted for instead of re-deriving
+// their allocation from scratch. That wiring is not yet in place -- see
+// the package doc comment.
+func RestoreNetworkAllocatorState(p StatePersister, na networkallocator.NetworkAllocator) error {
+	data, err := p.State(StateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to read network allocator snapshot")
+	}
+	snap, err := DecodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+	if snap == nil {
+		return nil
+	}
+	return na.Restore(snap)
+}
@@ -0,0 +1,39 @@
+// Package plugin defines a narrow, swarmkit-owned view of moby's
+// pkg/plugingetter.PluginGetter. It exists so that manager-side consumers
+// such as manager/allocator/cnmallocator can accept a source of discovered
+// engine plugins without importing moby's plugingetter package directly.
+// node wires the engine's real plugin store into this interface once, at
+// agent startup, via cnmallocator.AdaptPluginGetter; everything downstream
+// of that only ever sees Getter.
+package plugin
+
+// Getter looks up engine plugins by name and advertised capability, and
+// enumerates all known plugins advertising a given capability. A nil
+// Getter is valid and means no plugins are available.
+type Getter interface {
+	// Get looks up a plugin by name and capability, using the given lookup
+	// mode to decide whether the plugin may be activated on demand.
+	Get(name, capability string, mode int) (CompatPlugin, error)
+
+	// GetAllByCap returns all the plugins known to advertise the given
+	// capability.
+	GetAllByCap(capability string) ([]CompatPlugin, error)
+
+	// GetAllManagedPluginsByCap returns all managed plugins known to
+	// advertise the given capability.
+	GetAllManagedPluginsByCap(capability string) []CompatPlugin
+}
+
+// CompatPlugin is the narrow subset of moby's plugingetter.CompatPlugin
+// that swarmkit needs in order to talk to a plugin's RPC endpoint.
+type CompatPlugin interface {
+	Name() string
+	Client() Client
+	IsV1() bool
+}
+
+// Client is the narrow subset of moby's plugins.Client used to make RPC
+// calls against an activated plugin.
+type Client interface {
+	Call(serviceMethod string, args interface{}, ret interface{}) error
+}